@@ -0,0 +1,104 @@
+package multigz
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// A TruncatedError is returned by OpenAppend when the file ends with an
+// incomplete gzip member, for instance because a previous writer was
+// interrupted. Truncating the file to Offset drops the incomplete member,
+// so that appending can be retried.
+type TruncatedError struct {
+	Offset int64 // end of the last complete member
+	Extra  int64 // number of bytes of the incomplete member
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("incomplete gzip member at the end of the file: %d bytes after the last complete member, at offset %d",
+		e.Extra, e.Offset)
+}
+
+// OpenAppend opens the existing multi-gzip f for appending: it returns a
+// fixed-size Writer (like NewWriterLevelOptions) that adds new members at
+// the end of the file. The Offsets returned by the Writer are absolute
+// within the whole file, so they can be used with a Reader over it. Since
+// concatenated gzip members are a valid gzip stream, the file stays readable
+// by any gzip decompressor.
+//
+// The members of f are located through its embedded index or, if it has
+// none, through the size hints of their headers, without decompressing
+// them: this supports the files written by the fixed-size writer (and by
+// the other writers, when they write size hints), while other multi-gzips
+// are rejected. Only the last member is decompressed, to check that the
+// file ends with a complete gzip member. If the file ends with an
+// incomplete member instead, for instance because a previous writer was
+// interrupted, a *TruncatedError is returned.
+//
+// If the file contains an embedded index, it is removed; the Writer writes
+// a new one on Close if the EmbedIndex option is set, including both the
+// old and the new members. An empty file is valid, and it is written from
+// scratch.
+//
+// f must be opened for both reading and writing (os.O_RDWR).
+func OpenAppend(f *os.File, level int, blocksize int, opts *WriterOptions) (Writer, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := new(Index)
+	if fi.Size() > 0 {
+		if idx, err = ReadEmbeddedIndex(f); err != nil {
+			if idx, err = walkIndex(f); err != nil {
+				return nil, err
+			}
+		}
+		if idx.CompressedSize() > fi.Size() {
+			return nil, errInvalidIndex
+		}
+		if n := len(idx.Members); n > 0 {
+			if err := checkLastMember(f, &idx.Members[n-1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Drop anything after the last member (the embedded index)
+	end := idx.CompressedSize()
+	if err := f.Truncate(end); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return newNormalWriter(f, level, blocksize, opts, idx)
+}
+
+// checkLastMember decompresses the member m of f, which must be the last
+// one, checking that it is complete and that it matches m.
+func checkLastMember(f *os.File, m *Member) error {
+	gz, err := gzip.NewReader(io.NewSectionReader(f, m.Block, m.BlockSize))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	gz.Multistream(false)
+
+	// gzip verifies the CRC-32 and the length in the trailer
+	n, err := io.Copy(ioutil.Discard, gz)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if n != m.Size {
+		return errInvalidIndex
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOpenAppend(t *testing.T) {
+	data := loadDivina(t)
+
+	for _, embed := range []bool{false, true} {
+		out, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(out.Name())
+		out.Close()
+
+		// Write the data in three sessions, recording an Offset in each
+		type mark struct {
+			off Offset
+			pos int
+		}
+		var marks []mark
+		chunks := [][]byte{data[:100000], data[100000:400000], data[400000:]}
+		pos := 0
+		for _, chunk := range chunks {
+			f, err := os.OpenFile(out.Name(), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := OpenAppend(f, -1, 16384, &WriterOptions{EmbedIndex: embed})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(chunk[:1000]); err != nil {
+				t.Fatal(err)
+			}
+			marks = append(marks, mark{w.Offset(), pos + 1000})
+			if _, err := w.Write(chunk[1000:]); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			pos += len(chunk)
+		}
+
+		comp, err := ioutil.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(comp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(gz)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatal("invalid decompressed data:", err)
+		}
+
+		rd, err := NewReader(bytes.NewReader(comp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range marks {
+			if err := rd.SeekOffset(m.off); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 100)
+			if _, err := io.ReadFull(rd, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, data[m.pos:m.pos+100]) {
+				t.Errorf("invalid data at offset %v", m.off)
+			}
+		}
+
+		if embed {
+			idx, err := ReadEmbeddedIndex(bytes.NewReader(comp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idx.Size() != int64(len(data)) {
+				t.Error("embedded index does not cover all members:", idx.Size())
+			}
+		}
+
+		// Appending to a truncated file must fail, reporting where the
+		// last complete member ends.
+		size := int64(len(comp) / 2)
+		if err := os.Truncate(out.Name(), size); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(out.Name(), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = OpenAppend(f, -1, 16384, nil)
+		var te *TruncatedError
+		if !errors.As(err, &te) {
+			t.Fatal("truncated file not detected:", err)
+		}
+		if te.Offset <= 0 || te.Offset+te.Extra != size {
+			t.Errorf("invalid truncation reported: %+v", te)
+		}
+
+		// Dropping the incomplete member makes the file valid again
+		if err := f.Truncate(te.Offset); err != nil {
+			t.Fatal(err)
+		}
+		w, err := OpenAppend(f, -1, 16384, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		comp, err = ioutil.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err = gzip.NewReader(bytes.NewReader(comp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = ioutil.ReadAll(gz)
+		if err != nil || !bytes.HasPrefix(data, got) {
+			t.Error("invalid data after dropping the incomplete member:", err)
+		}
+	}
+}
+
+func TestOpenAppendInvalid(t *testing.T) {
+	data := loadDivina(t)
+
+	var fixed bytes.Buffer
+	w, err := NewWriterLevel(&fixed, -1, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the data of the last member, leaving its header and trailer
+	// (and so the index built from the size hints) intact.
+	idx, err := BuildIndex(bytes.NewReader(fixed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := idx.Members[len(idx.Members)-1]
+	corrupted := append([]byte(nil), fixed.Bytes()...)
+	corrupted[last.Block+last.BlockSize/2] ^= 0xff
+
+	for name, comp := range map[string][]byte{
+		"rsyncable without size hints": compressUnhinted(t),
+		"corrupted last member":        corrupted,
+	} {
+		out, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(out.Name())
+		if _, err := out.Write(comp); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenAppend(out, -1, 16384, nil); err == nil {
+			t.Error("file accepted for appending:", name)
+		}
+		out.Close()
+	}
+}
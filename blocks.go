@@ -2,37 +2,221 @@ package multigz
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
 
 	gzip "github.com/klauspost/pgzip"
 )
 
 const DefaultBlockSize = 64 * 1024
 
+// With record-aligned blocks, the default maximum block size is this many
+// times the block size.
+const defaultMaxBlockFactor = 4
+
 type blockWriter struct {
 	gz     *gzip.Writer
 	underw *countWriter
 	blkoff int64
+	log    *memberLog
+	buf    bytes.Buffer
+	closed bool
+
+	// Blocks are size bytes long or, with record-aligned blocks, they end
+	// at a boundary found by split. carry holds the data after the last
+	// block, which is written at the beginning of the next one.
+	size  int
+	split RecordSplitFunc
+	max   int
+	carry []byte
+
+	// Parallel compression: free is the pool of idle compressors, while
+	// pending holds the blocks being compressed, in file order.
+	free    chan *gzip.Writer
+	pending []*blockJob
+	err     error
 }
 
-func (bw *blockWriter) Write(data []byte) (n int, err error) {
-	bw.gz.Reset(bw.underw)
-	n, err = bw.gz.Write(data)
-	if err != nil {
-		return
+// blockJob is a block being compressed in background.
+type blockJob struct {
+	data   []byte
+	member bytes.Buffer
+	err    error
+	done   chan struct{}
+}
+
+// compressMember compresses data as a single gzip member into buf. The member
+// is generated in memory, so that its size can be stored in the header
+// before writing it out.
+func compressMember(gz *gzip.Writer, buf *bytes.Buffer, data []byte) error {
+	buf.Reset()
+	gz.Reset(buf)
+	gz.Extra = newSizeHint()
+	if _, err := gz.Write(data); err != nil {
+		return err
 	}
-	err = bw.gz.Close()
-	if err != nil {
-		return
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	patchSizeHint(buf.Bytes())
+	return nil
+}
+
+// Write writes the complete blocks in carry+data, and keeps the remaining
+// data in carry. Normally, bufio.Writer calls it with exactly one block of
+// data, but it passes bigger writes through without buffering them.
+func (bw *blockWriter) Write(data []byte) (int, error) {
+	buf := data
+	if len(bw.carry) > 0 {
+		buf = append(bw.carry, data...)
+	}
+	for len(buf) >= bw.size {
+		n := bw.blockLen(buf)
+		if n <= 0 {
+			break
+		}
+		if _, err := bw.writeBlock(buf[:n]); err != nil {
+			return 0, err
+		}
+		buf = buf[n:]
+	}
+	bw.carry = append(bw.carry[:0], buf...)
+	return len(data), nil
+}
+
+// blockLen returns the length of the block at the beginning of buf, which
+// holds at least a block of data, or zero if more data is needed to find
+// a record boundary. Without record-aligned blocks, a large Write is cut
+// into blocks of the block size, as if it went through bufio.Writer.
+func (bw *blockWriter) blockLen(buf []byte) int {
+	if bw.split == nil {
+		return bw.size
+	}
+	// Add whole records until the block size is reached, without
+	// exceeding the maximum block size.
+	n := 0
+	for n < bw.size {
+		rec := bw.split(buf[n:])
+		if rec <= 0 || n+rec > bw.max {
+			break
+		}
+		n += rec
 	}
+	if n >= bw.size {
+		return n
+	}
+	// The next record is incomplete, or too long: wait for the rest of
+	// it, unless it does not fit in the maximum block size anyway.
+	if len(buf) >= bw.max {
+		if n > 0 {
+			return n
+		}
+		// A single record longer than the maximum block size
+		return bw.max
+	}
+	return 0
+}
+
+// flushCarry writes the data left after the last block as a block on its
+// own.
+func (bw *blockWriter) flushCarry() error {
+	if len(bw.carry) == 0 {
+		return nil
+	}
+	_, err := bw.writeBlock(bw.carry)
+	bw.carry = bw.carry[:0]
+	return err
+}
+
+// writeBlock compresses data as a single member, and writes it out.
+func (bw *blockWriter) writeBlock(data []byte) (n int, err error) {
+	if bw.free != nil {
+		return bw.writeParallel(data)
+	}
+	if err = compressMember(bw.gz, &bw.buf, data); err != nil {
+		return 0, err
+	}
+	if err = bw.emit(data, bw.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// emit writes a compressed member to the underlying writer.
+func (bw *blockWriter) emit(data []byte, member []byte) error {
+	if _, err := bw.underw.Write(member); err != nil {
+		return err
+	}
+	bw.log.write(data)
+	bw.log.end(bw.blkoff, bw.underw.off)
 	bw.blkoff = bw.underw.off
-	return
+	return nil
+}
+
+// writeParallel starts compressing data in background, as soon as there is
+// an idle compressor, and then writes out the blocks that are completed.
+// Since blocks are written in order, and each one is compressed with the
+// same settings, the output is identical to the serial compression.
+func (bw *blockWriter) writeParallel(data []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+
+	job := &blockJob{
+		// The caller (bufio.Writer) reuses its buffer after we
+		// return, so we need a copy.
+		data: append([]byte(nil), data...),
+		done: make(chan struct{}),
+	}
+	gz := <-bw.free
+	go func() {
+		job.err = compressMember(gz, &job.member, job.data)
+		bw.free <- gz
+		close(job.done)
+	}()
+	bw.pending = append(bw.pending, job)
+
+	// Write out the completed blocks, waiting for the oldest ones if there
+	// are too many of them in memory.
+	for len(bw.pending) > 0 {
+		job := bw.pending[0]
+		if len(bw.pending) <= 2*cap(bw.free) {
+			select {
+			case <-job.done:
+			default:
+				return len(data), nil
+			}
+		}
+		if bw.err = bw.emitJob(job); bw.err != nil {
+			return 0, bw.err
+		}
+	}
+	return len(data), nil
+}
+
+func (bw *blockWriter) emitJob(job *blockJob) error {
+	<-job.done
+	bw.pending = bw.pending[1:]
+	if job.err != nil {
+		return job.err
+	}
+	return bw.emit(job.data, job.member.Bytes())
+}
+
+// drain waits for all the blocks being compressed in background, and writes
+// them out.
+func (bw *blockWriter) drain() error {
+	for len(bw.pending) > 0 && bw.err == nil {
+		bw.err = bw.emitJob(bw.pending[0])
+	}
+	return bw.err
 }
 
 type normalWriter struct {
 	*bufio.Writer
-	io.Closer
 	blkw *blockWriter
+	opts WriterOptions
 }
 
 // Create a new compressing writer that will generate a multi-gzip, segmenting
@@ -41,6 +225,19 @@ type normalWriter struct {
 // You can use multigz.DefaultBlockSize as a reasonable default (64kb) that
 // balances decompression speed and compression overhead.
 func NewWriterLevel(w io.Writer, level int, blocksize int) (Writer, error) {
+	return NewWriterLevelOptions(w, level, blocksize, nil)
+}
+
+// Create a new compressing writer like NewWriterLevel, but with additional
+// options; see WriterOptions for the available ones.
+func NewWriterLevelOptions(w io.Writer, level int, blocksize int, opts *WriterOptions) (Writer, error) {
+	return newNormalWriter(w, level, blocksize, opts, nil)
+}
+
+// newNormalWriter creates a fixed-size writer. If prev is not nil, w is
+// positioned at the end of an existing multi-gzip described by prev, so the
+// offsets start from there, and the embedded index includes its members.
+func newNormalWriter(w io.Writer, level int, blocksize int, opts *WriterOptions, prev *Index) (Writer, error) {
 	underw := &countWriter{Writer: w}
 	gz, err := gzip.NewWriterLevel(underw, level)
 	if err != nil {
@@ -49,26 +246,94 @@ func NewWriterLevel(w io.Writer, level int, blocksize int) (Writer, error) {
 	blockw := &blockWriter{
 		gz:     gz,
 		underw: underw,
+		log:    newMemberLog(),
+	}
+	if prev != nil {
+		underw.off = prev.CompressedSize()
+		blockw.blkoff = underw.off
+		blockw.log.idx.Members = append([]Member(nil), prev.Members...)
 	}
 	buf := bufio.NewWriterSize(blockw, blocksize)
-	return normalWriter{
+	blockw.size = buf.Size()
+	nw := normalWriter{
 		Writer: buf,
-		Closer: gz,
 		blkw:   blockw,
-	}, nil
+	}
+	if opts != nil {
+		nw.opts = *opts
+	}
+	if nw.opts.MaxBlockSize < 0 {
+		return nil, errInvalidOptions
+	}
+	blockw.split = nw.opts.Split
+	blockw.max = nw.opts.MaxBlockSize
+	if blockw.split != nil && blockw.max == 0 {
+		// Bound the blocks anyway, so that a long record is not scanned
+		// over and over while waiting for its end.
+		blockw.max = defaultMaxBlockFactor * blockw.size
+	}
+	if nw.opts.Workers > 1 {
+		blockw.free = make(chan *gzip.Writer, nw.opts.Workers)
+		for i := 0; i < nw.opts.Workers; i++ {
+			gz, _ := gzip.NewWriterLevel(ioutil.Discard, level)
+			blockw.free <- gz
+		}
+	}
+	return nw, nil
 }
 
+// Offset returns the Offset of the current position. With parallel
+// compression, the current block starts after the blocks still being
+// compressed in background, so Offset waits for them to know their size.
 func (nw normalWriter) Offset() Offset {
+	blkoff := nw.blkw.blkoff
+	for _, job := range nw.blkw.pending {
+		<-job.done
+		blkoff += int64(job.member.Len())
+	}
 	return Offset{
-		Block: nw.blkw.blkoff,
-		Off:   int64(nw.Writer.Buffered()),
+		Block: blkoff,
+		Off:   int64(len(nw.blkw.carry) + nw.Writer.Buffered()),
 	}
 }
 
+func (nw normalWriter) Cut() error {
+	if err := nw.Writer.Flush(); err != nil {
+		return err
+	}
+	if err := nw.blkw.flushCarry(); err != nil {
+		return err
+	}
+	return nw.blkw.drain()
+}
+
 func (nw normalWriter) Close() error {
+	if nw.blkw.closed {
+		return nil
+	}
 	err := nw.Writer.Flush()
 	if err != nil {
 		return err
 	}
-	return nw.Closer.Close()
+	if err := nw.blkw.flushCarry(); err != nil {
+		return err
+	}
+	if err := nw.blkw.drain(); err != nil {
+		return err
+	}
+	// Make sure that there is at least one (possibly empty) member, as
+	// an empty file is not a valid gzip.
+	if len(nw.blkw.log.idx.Members) == 0 {
+		if _, err := nw.blkw.writeBlock(nil); err != nil {
+			return err
+		}
+		if err := nw.blkw.drain(); err != nil {
+			return err
+		}
+	}
+	nw.blkw.closed = true
+	if nw.opts.EmbedIndex {
+		return writeIndexMembers(nw.blkw.underw, &nw.blkw.log.idx)
+	}
+	return nil
 }
@@ -0,0 +1,115 @@
+package multigz
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A BlockCache keeps the decompressed content of recently used gzip members
+// in memory, so that repeated seeks into the same members do not need to
+// decompress them again. The cache is bounded by the total size of the
+// decompressed data, and it evicts the least recently used members first.
+//
+// A single BlockCache can be shared by multiple Readers and ReaderAts (see
+// their SetCache methods), also concurrently. The cached members are
+// identified by the ID passed to SetCache, together with their offset in
+// the compressed file: readers using the same ID share the cached members.
+// The cache holds no reference to the readers nor to their files.
+type BlockCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+	hits    int64
+	misses  int64
+}
+
+// CacheStats reports the usage of a BlockCache.
+type CacheStats struct {
+	Hits   int64 // number of lookups that found the member in the cache
+	Misses int64 // number of lookups that had to decompress the member
+	Blocks int   // number of members in the cache
+	Size   int64 // total size of the decompressed data in the cache
+}
+
+type cacheKey struct {
+	id    string
+	block int64
+}
+
+type cacheEntry struct {
+	key       cacheKey
+	data      []byte
+	blockSize int64
+}
+
+// NewBlockCache creates a BlockCache holding up to maxBytes of decompressed
+// data. Members bigger than maxBytes are never cached.
+func NewBlockCache(maxBytes int64) *BlockCache {
+	return &BlockCache{
+		max:     maxBytes,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the decompressed data and the compressed size of the member
+// at offset block, if it is cached. The data must not be modified.
+func (c *BlockCache) get(id string, block int64) ([]byte, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey{id, block}]
+	if !ok {
+		c.misses++
+		return nil, 0, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	e := el.Value.(*cacheEntry)
+	return e.data, e.blockSize, true
+}
+
+// contains reports whether the member is cached, without affecting the
+// statistics nor the eviction order.
+func (c *BlockCache) contains(id string, block int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[cacheKey{id, block}]
+	return ok
+}
+
+// add stores the decompressed data of the member at offset block, evicting
+// the least recently used members if needed.
+func (c *BlockCache) add(id string, block int64, blockSize int64, data []byte) {
+	if int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{id, block}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.size+int64(len(data)) > c.max {
+		el := c.lru.Back()
+		e := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.data))
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data, blockSize: blockSize})
+	c.size += int64(len(data))
+}
+
+// Stats returns the current statistics of the cache.
+func (c *BlockCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Blocks: c.lru.Len(),
+		Size:   c.size,
+	}
+}
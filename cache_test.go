@@ -0,0 +1,177 @@
+package multigz
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := loadDivina(t)
+	idx, err := BuildIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is big enough for a few members only, and it is shared
+	// by a Reader and a ReaderAt over the same file.
+	cache := NewBlockCache(4 * idx.Members[0].Size)
+	ra, err := NewReaderAt(f, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.SetCache(cache, "divina2")
+	f.Seek(0, io.SeekStart)
+	rd, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.SetIndex(idx)
+	rd.SetCache(cache, "divina2")
+
+	// Bounce between a few hot positions
+	hot := []int64{1000, 250000, 400000, int64(len(data)) - 5000}
+	for i := 0; i < 200; i++ {
+		off := hot[rand.Intn(len(hot))] + rand.Int63n(2000)
+		p := make([]byte, rand.Intn(10000)+1)
+
+		n, err := ra.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReaderAt: invalid data at %d", off)
+		}
+
+		o, err := idx.Offset(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rd.SeekOffset(o); err != nil {
+			t.Fatal(err)
+		}
+		n, err = io.ReadFull(rd, p)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+			t.Fatalf("Reader: invalid data at %d", off)
+		}
+		if pos, err := idx.Pos(rd.Offset()); err != nil || pos != off+int64(n) {
+			t.Fatalf("Reader: invalid offset after read at %d: %v (%v)", off, rd.Offset(), err)
+		}
+	}
+
+	st := cache.Stats()
+	if st.Hits < st.Misses {
+		t.Error("too few cache hits:", st)
+	}
+	if st.Size > 4*idx.Members[0].Size || st.Blocks > 4 {
+		t.Error("cache is too big:", st)
+	}
+
+	// Reading sequentially from the cache must reach the end of the file
+	o, _ := idx.Offset(hot[0])
+	rd.SeekOffset(o)
+	rest, err := ioutil.ReadAll(rd)
+	if err != nil || !bytes.Equal(rest, data[hot[0]:]) {
+		t.Error("invalid data reading until EOF:", err)
+	}
+}
+
+func TestBlockCacheID(t *testing.T) {
+	// Two different files sharing the cache, with their members at the
+	// same offsets: they must not see each other's data.
+	cache := NewBlockCache(1024 * 1024)
+	for _, text := range []string{"first file", "second file"} {
+		var buf bytes.Buffer
+		w, err := NewWriterLevel(&buf, -1, DefaultBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ra, err := NewReaderAt(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ra.SetCache(cache, text)
+		p := make([]byte, len(text))
+		if _, err := ra.ReadAt(p, 0); err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != text {
+			t.Errorf("invalid data from the cache: %q instead of %q", p, text)
+		}
+	}
+	if st := cache.Stats(); st.Blocks != 2 {
+		t.Error("invalid number of cached members:", st.Blocks)
+	}
+}
+
+func TestBlockCacheBigMembers(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := loadDivina(t)
+	idx, err := BuildIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Members bigger than the cache are streamed, and never cached
+	cache := NewBlockCache(idx.Members[0].Size / 2)
+	ra, err := NewReaderAt(f, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.SetCache(cache, "divina2")
+	f.Seek(0, io.SeekStart)
+	rd, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.SetIndex(idx)
+	rd.SetCache(cache, "divina2")
+
+	for _, off := range []int64{1000, 250000, 400000} {
+		p := make([]byte, 5000)
+		if _, err := ra.ReadAt(p, off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, data[off:off+int64(len(p))]) {
+			t.Fatalf("ReaderAt: invalid data at %d", off)
+		}
+
+		o, err := idx.Offset(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rd.SeekOffset(o); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(rd, p); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, data[off:off+int64(len(p))]) {
+			t.Fatalf("Reader: invalid data at %d", off)
+		}
+	}
+	if st := cache.Stats(); st.Blocks != 0 {
+		t.Error("members bigger than the cache were cached:", st)
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"compress/gzip"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/rasky/multigz"
+	"github.com/rasky/multigz/tarindex"
 
 	"github.com/djherbis/atime"
 	"github.com/spf13/pflag"
@@ -40,12 +43,28 @@ var flagL7 = pflag.Bool("7", false, "")
 var flagL8 = pflag.Bool("8", false, "")
 var flagL9 = pflag.BoolP("best", "9", false, "compress better")
 var flagRsyncable = pflag.Bool("rsyncable", false, "make rsync-friendly archive")
+var flagFastCDC = pflag.Bool("fastcdc", false, "segment with content-defined chunking (FastCDC)")
+var flagIndex = pflag.Bool("index", false, "also write a block index into FILE.gz.gzi")
+var flagList = pflag.BoolP("list", "l", false, "list compressed file contents, like gzip -l")
+var flagVerbose = pflag.BoolP("verbose", "v", false, "verbose mode")
+var flagTarList = pflag.Bool("tar-list", false, "list the files in a .tar.gz multi-gzip")
+var flagExtract = pflag.String("extract", "", "extract file NAME of a .tar.gz multi-gzip to standard output")
+var flagCat = pflag.Bool("cat", false, "concatenate multi-gzip files to standard output")
+var flagMerge = pflag.Bool("merge", false, "with --cat, merge the block indexes of the files")
+var flagSplit = pflag.String("split", "", "split multi-gzip files into parts of at most SIZE bytes")
+var flagRange = pflag.String("range", "", "write decompressed bytes START:END to standard output")
+var flagOffset = pflag.String("offset", "", "write decompressed data from BLOCK:OFF to standard output")
+var flagLength = pflag.Int64("length", -1, "with --offset, number of bytes to write")
 
 const (
 	ModeCompress = iota
 	ModeDecompress
 	ModeTest
 	ModeTestMulti
+	ModeList
+	ModeTarList
+	ModeTarExtract
+	ModeRange
 )
 
 var Mode = ModeCompress
@@ -56,6 +75,7 @@ var IsStdinTerm bool = terminal.IsTerminal(0)
 var IsStdoutTerm bool = terminal.IsTerminal(1)
 
 func main() {
+	pflag.Lookup("split").NoOptDefVal = "1G"
 	pflag.Parse()
 	if *flagHelp {
 		Usage()
@@ -89,6 +109,20 @@ func main() {
 	}
 
 	Files = pflag.Args()
+	if *flagMerge && !*flagCat {
+		fatal("--merge can only be used with --cat")
+		os.Exit(1)
+	}
+	if *flagRsyncable && *flagFastCDC {
+		fatal("--rsyncable and --fastcdc cannot be used together")
+		os.Exit(1)
+	}
+	if *flagCat {
+		os.Exit(Cat(Files))
+	}
+	if *flagSplit != "" {
+		os.Exit(Split(Files))
+	}
 	if len(Files) == 0 {
 		Files = []string{"-"}
 	}
@@ -108,6 +142,26 @@ func main() {
 		Mode = ModeDecompress
 		*flagStdout = true
 	}
+	if *flagList {
+		Mode = ModeList
+	}
+	if *flagTarList {
+		Mode = ModeTarList
+	}
+	if *flagExtract != "" {
+		Mode = ModeTarExtract
+	}
+	if *flagRange != "" || *flagOffset != "" {
+		Mode = ModeRange
+	}
+	if *flagRange != "" && *flagOffset != "" {
+		fatal("--range and --offset cannot be used together")
+		os.Exit(1)
+	}
+	if pflag.CommandLine.Changed("length") && (*flagOffset == "" || *flagLength < 0) {
+		fatal("--length requires --offset, and a non-negative length")
+		os.Exit(1)
+	}
 
 	SetSignalHandler()
 	os.Exit(Compress())
@@ -166,6 +220,10 @@ func compressFile(fn string) bool {
 			fatal("cannot compress to terminal (use -f to force)")
 			return false
 		}
+		if Mode == ModeCompress && *flagIndex {
+			fatal("cannot write an index when compressing to standard output")
+			return false
+		}
 	} else {
 		var outfn string
 		var force bool
@@ -223,6 +281,8 @@ func compressFile(fn string) bool {
 	case ModeCompress:
 		if *flagRsyncable {
 			zw, err = multigz.NewWriterLevelRsyncable(w, Level)
+		} else if *flagFastCDC {
+			zw, err = multigz.NewWriterLevelFastCDC(w, Level, nil)
 		} else {
 			zw, err = multigz.NewWriterLevel(w, Level, multigz.DefaultBlockSize)
 		}
@@ -248,6 +308,12 @@ func compressFile(fn string) bool {
 
 	zw.Close()
 	OutFn = ""
+	if Mode == ModeCompress && *flagIndex {
+		if err := writeIndex(w); err != nil {
+			fatal(err)
+			return false
+		}
+	}
 	switch Mode {
 	case ModeCompress, ModeDecompress:
 		CopyStat(w, f)
@@ -262,20 +328,519 @@ func compressFile(fn string) bool {
 	return true
 }
 
+// Write the block index of the multi-gzip f into a .gzi file next to it.
+func writeIndex(f *os.File) error {
+	idx, err := multigz.BuildIndex(f)
+	if err != nil {
+		return err
+	}
+	w, err := os.Create(f.Name() + ".gzi")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := idx.WriteTo(w); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return w.Close()
+}
+
+// List or extract the files of a .tar.gz multi-gzip, seeking over the
+// contents of the files and directly to the requested one.
+func tarFile(fn string) bool {
+	if fn == "-" {
+		fatal("cannot seek within standard input")
+		return false
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		fatal(err)
+		return false
+	}
+	defer f.Close()
+
+	// With the block index, only the members holding the tar headers
+	// need to be decompressed.
+	mi, err := multigz.LoadIndex(f)
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatal(fn, err)
+		return false
+	}
+	r, err := multigz.NewReader(f)
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+	r.SetIndex(mi)
+	idx, err := tarindex.Build(r)
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+
+	switch Mode {
+	case ModeTarList:
+		for _, e := range idx.Entries {
+			fmt.Println(e.Header.Name)
+		}
+	case ModeTarExtract:
+		zf, err := idx.Open(*flagExtract)
+		if err != nil {
+			fatal(fn, err)
+			return false
+		}
+		if _, err := io.Copy(os.Stdout, zf); err != nil {
+			fatal(fn, err)
+			return false
+		}
+	}
+	return true
+}
+
+// Totals printed by --list when listing multiple files.
+type listStats struct {
+	compressed   int64
+	uncompressed int64
+}
+
+// Print the header of --list, like gzip -l.
+func listHeader() {
+	fmt.Print("         compressed        uncompressed  ratio      crc")
+	if *flagVerbose {
+		fmt.Print("  members        min        avg        max multigz")
+	}
+	fmt.Println(" uncompressed_name")
+}
+
+func ratio(compressed, uncompressed int64) float64 {
+	if uncompressed == 0 {
+		return 0
+	}
+	return 100 * float64(uncompressed-compressed) / float64(uncompressed)
+}
+
+// Print the sizes and the CRC of a multi-gzip, like gzip -l. Unlike gzip,
+// the uncompressed size and the CRC are those of the whole decompressed
+// stream, not just of its last member. With --verbose, also print the
+// number of members, their decompressed sizes, and whether the file is
+// a multi-gzip.
+func listFile(fn string, total *listStats) bool {
+	if fn == "-" {
+		fatal("cannot seek within standard input")
+		return false
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		fatal(err)
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		fatal(err)
+		return false
+	}
+	idx, err := multigz.LoadIndex(f)
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+
+	var crc uint32
+	var min, max int64
+	for i, m := range idx.Members {
+		crc = crc32Combine(crc, m.CRC32, m.Size)
+		if i == 0 || m.Size < min {
+			min = m.Size
+		}
+		if m.Size > max {
+			max = m.Size
+		}
+	}
+	total.compressed += fi.Size()
+	total.uncompressed += idx.Size()
+
+	fmt.Printf("%19d %19d %5.1f%% %08x", fi.Size(), idx.Size(), ratio(fi.Size(), idx.Size()), crc)
+	if *flagVerbose {
+		var avg int64
+		if n := int64(len(idx.Members)); n > 0 {
+			avg = idx.Size() / n
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			fatal(fn, err)
+			return false
+		}
+		multi := "no"
+		if multigz.IsProbablyMultiGzip(f, multigz.DefaultPeekSize) {
+			multi = "yes"
+		}
+		fmt.Printf(" %8d %10d %10d %10d %-7s", len(idx.Members), min, avg, max, multi)
+	}
+	fmt.Println("", strings.TrimSuffix(fn, ".gz"))
+	return true
+}
+
+// Combine crc1, the CRC32 of a stream A, with crc2, the CRC32 of a stream B
+// of length len2, into the CRC32 of A followed by B (like zlib's
+// crc32_combine).
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	// odd is the operator that appends a single zero bit to the CRC
+	var even, odd [32]uint32
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2Square(even[:], odd[:]) // two zero bits
+	gf2Square(odd[:], even[:]) // four zero bits
+
+	// Append len2 zero bytes to crc1, squaring the operator for each bit
+	// of len2
+	for {
+		gf2Square(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2Times(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2Square(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2Times(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2Times(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2Square(square, mat []uint32) {
+	for n := range mat {
+		square[n] = gf2Times(mat, mat[n])
+	}
+}
+
+// Parse the START:END argument of --range; END can be omitted to mean the
+// end of the file.
+func parseRange(s string) (int64, int64, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid range: %q (expected START:END)", s)
+	}
+	start, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range: %q", s)
+	}
+	end := int64(-1)
+	if s[i+1:] != "" {
+		end, err = strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range: %q", s)
+		}
+	}
+	return start, end, nil
+}
+
+// Parse the BLOCK:OFF argument of --offset.
+func parseOffset(s string) (multigz.Offset, error) {
+	var o multigz.Offset
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return o, fmt.Errorf("invalid offset: %q (expected BLOCK:OFF)", s)
+	}
+	var err1, err2 error
+	o.Block, err1 = strconv.ParseInt(s[:i], 10, 64)
+	o.Off, err2 = strconv.ParseInt(s[i+1:], 10, 64)
+	if err1 != nil || err2 != nil {
+		return o, fmt.Errorf("invalid offset: %q", s)
+	}
+	return o, nil
+}
+
+// Write a slice of the decompressed data of a multi-gzip to standard output,
+// decompressing only the members that overlap with it.
+func rangeFile(fn string) bool {
+	if fn == "-" {
+		fatal("cannot seek within standard input")
+		return false
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		fatal(err)
+		return false
+	}
+	defer f.Close()
+
+	idx, err := multigz.LoadIndex(f)
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+
+	// Compute the slice as a start position and a length (-1 means up
+	// to the end of the data).
+	var start, length int64
+	if *flagRange != "" {
+		var end int64
+		start, end, err = parseRange(*flagRange)
+		length = -1
+		if end >= 0 {
+			length = end - start
+		}
+	} else {
+		var o multigz.Offset
+		if o, err = parseOffset(*flagOffset); err == nil {
+			start, err = idx.Pos(o)
+		}
+		length = *flagLength
+	}
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+	size := idx.Size()
+	if start > size {
+		fatal(fn, fmt.Sprintf("the slice starts past the end of the data (%d bytes)", size))
+		return false
+	}
+	if length < 0 || length > size-start {
+		length = size - start
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatal(fn, err)
+		return false
+	}
+	r, err := multigz.NewReader(f)
+	if err != nil {
+		fatal(fn, err)
+		return false
+	}
+	r.SetIndex(idx)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		fatal(fn, err)
+		return false
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if _, err := io.CopyN(w, r, length); err != nil {
+		fatal(fn, err)
+		return false
+	}
+	if err := w.Flush(); err != nil {
+		fatal(err)
+		return false
+	}
+	return true
+}
+
+// Concatenate multi-gzip files to standard output. With --merge, the
+// embedded indexes of the files are dropped, and the combined index is
+// embedded at the end of the output.
+func Cat(files []string) int {
+	if len(files) == 0 {
+		fatal("--cat: no input files")
+		return 1
+	}
+	if IsStdoutTerm && !*flagForce {
+		fatal("cannot write compressed data to terminal (use -f to force)")
+		return 1
+	}
+
+	var srcs []io.ReadSeeker
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			fatal(err)
+			return 1
+		}
+		defer f.Close()
+		srcs = append(srcs, f)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if *flagMerge {
+		idx, _, err := multigz.Concat(w, srcs...)
+		if err == nil {
+			err = multigz.WriteEmbeddedIndex(w, idx)
+		}
+		if err != nil {
+			fatal(err)
+			return 1
+		}
+	} else {
+		for _, src := range srcs {
+			if _, err := io.Copy(w, src); err != nil {
+				fatal(err)
+				return 1
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fatal(err)
+		return 1
+	}
+	return 0
+}
+
+// Parse a size with an optional K, M or G suffix (powers of 1024).
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * mult, nil
+}
+
+// Split each multi-gzip file into parts of at most --split bytes, cutting it
+// at member boundaries. The parts of FILE.gz are named FILE.000.gz,
+// FILE.001.gz and so on, and each one gets its block index in a .gzi file.
+// If splitting a file fails, the parts already written for it are removed.
+func Split(files []string) int {
+	if len(files) == 0 {
+		fatal("--split: no input files")
+		return 1
+	}
+	size, err := parseSize(*flagSplit)
+	if err != nil {
+		fatal(err)
+		return 1
+	}
+
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			fatal(err)
+			return 1
+		}
+		defer f.Close()
+
+		base := strings.TrimSuffix(fn, ".gz")
+		var outs []*os.File
+		parts, err := multigz.Split(f, size, func(i int) (io.Writer, error) {
+			outfn := fmt.Sprintf("%s.%03d.gz", base, i)
+			if _, err := os.Stat(outfn); err == nil && !*flagForce {
+				return nil, fmt.Errorf("%s already exists (use -f to force)", outfn)
+			}
+			w, err := os.Create(outfn)
+			if err != nil {
+				return nil, err
+			}
+			outs = append(outs, w)
+			return w, nil
+		})
+		for _, w := range outs {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err == nil {
+			err = writePartIndexes(outs, parts)
+		}
+		if err != nil {
+			for _, w := range outs {
+				os.Remove(w.Name())
+				os.Remove(w.Name() + ".gzi")
+			}
+			fatal(fn, err)
+			return 1
+		}
+	}
+	return 0
+}
+
 func Compress() int {
+	var total listStats
+	if Mode == ModeList {
+		listHeader()
+	}
 	for _, fn := range Files {
-		if !compressFile(fn) {
+		ok := false
+		switch Mode {
+		case ModeList:
+			ok = listFile(fn, &total)
+		case ModeTarList, ModeTarExtract:
+			ok = tarFile(fn)
+		case ModeRange:
+			ok = rangeFile(fn)
+		default:
+			ok = compressFile(fn)
+		}
+		if !ok {
 			return 1
 		}
 	}
+	if Mode == ModeList && len(Files) > 1 {
+		fmt.Printf("%19d %19d %5.1f%% %8s", total.compressed, total.uncompressed,
+			ratio(total.compressed, total.uncompressed), "")
+		if *flagVerbose {
+			fmt.Printf(" %8s %10s %10s %10s %-7s", "", "", "", "", "")
+		}
+		fmt.Println(" (totals)")
+	}
 	return 0
 }
 
+// writePartIndexes writes the block index of each part next to it.
+func writePartIndexes(outs []*os.File, parts []*multigz.Index) error {
+	for i, idx := range parts {
+		w, err := os.Create(outs[i].Name() + ".gzi")
+		if err != nil {
+			return err
+		}
+		_, err = idx.WriteTo(w)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Usage() {
 	// We prefer not ot use pflag.Usage for the following reason:
 	// 1) It orders by longname option, which is confusing for this option set
 	// 2) It shows "[=false]" next to all boolean options
 	fmt.Println(`Usage: multigz [OPTION]... [FILE]...
+  or:  multigz --cat [--merge] FILE...
+  or:  multigz --split[=SIZE] FILE...
 Compress or uncompress FILEs (by default, compress FILES in-place).
 
 Mandatory arguments to long options are mandatory for short options too.
@@ -285,6 +850,7 @@ Mandatory arguments to long options are mandatory for short options too.
   -f, --force       force overwrite of output file and compress links
   -h, --help        give this help
   -k, --keep        keep (don't delete) input files
+  -l, --list        list compressed file contents, like gzip -l
   -L, --license     display software license
   -t, --test        test compressed file integrity
   -T, --testmulti   like -t, but also verifies that it is a multi-gzip
@@ -293,11 +859,36 @@ Mandatory arguments to long options are mandatory for short options too.
   -1, --fast        compress faster
   -9, --best        compress better
       --rsyncable   make rsync-friendly archive
+      --fastcdc     segment with content-defined chunking (FastCDC)
+      --index       also write a block index into FILE.gz.gzi
+      --tar-list    list the files in a .tar.gz multi-gzip
+      --extract=NAME
+                    extract file NAME of a .tar.gz multi-gzip to standard output
+      --range=START:END
+                    write decompressed bytes START to END (excluded) to
+                    standard output; END can be omitted
+      --offset=BLOCK:OFF
+                    write decompressed data from the Offset BLOCK:OFF
+                    (compressed member, offset within it) to standard output
+      --length=N    with --offset, write at most N bytes
+      --cat         concatenate multi-gzip FILEs to standard output
+      --merge       with --cat, merge the block indexes of the FILEs
+      --split[=SIZE]
+                    split multi-gzip FILEs into parts of at most SIZE bytes
 
 With no FILE, or when FILE is -, read standard input.
 
-Report bugs to <rasky@develer.com>.
-`)
+With --cat, multi-gzip FILEs are concatenated to standard output. With
+--merge, the members are copied without their embedded indexes, and the
+combined block index is embedded at the end.
+
+With --split, multi-gzip FILEs are split into parts of at most SIZE bytes
+(default 1G; K, M and G suffixes are accepted), cutting them at member
+boundaries without recompressing them. The parts of FILE.gz are named
+FILE.000.gz, FILE.001.gz, and so on, each one with its own block index in
+a .gzi file.
+
+Report bugs to <rasky@develer.com>.`)
 }
 
 func License() {
@@ -0,0 +1,52 @@
+package multigz
+
+import (
+	"io"
+)
+
+// Concat writes the concatenation of the multi-gzips srcs into dst, copying
+// their members verbatim, without recompressing them. It returns the Index
+// of the resulting multi-gzip, and the offset in dst where each source
+// begins: an Offset obtained for the i-th source can be used on the result
+// by adding base[i] to its Block field.
+//
+// The embedded indexes of the sources (if any) are not copied, as they would
+// be wrong for the result; use WriteEmbeddedIndex to append the returned
+// Index to dst. The sources are read from their beginning, irrespective of
+// their current position.
+func Concat(dst io.Writer, srcs ...io.ReadSeeker) (*Index, []int64, error) {
+	idx := new(Index)
+	base := make([]int64, len(srcs))
+	var block, start int64
+	for i, src := range srcs {
+		sidx, err := ReadEmbeddedIndex(src)
+		if err != nil {
+			if sidx, err = BuildIndex(src); err != nil {
+				return nil, nil, err
+			}
+		}
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.CopyN(dst, src, sidx.CompressedSize()); err != nil {
+			return nil, nil, err
+		}
+
+		base[i] = block
+		for _, m := range sidx.Members {
+			m.Block += block
+			m.Start += start
+			idx.Members = append(idx.Members, m)
+		}
+		block += sidx.CompressedSize()
+		start += sidx.Size()
+	}
+	return idx, base, nil
+}
+
+// WriteEmbeddedIndex writes idx to w as an embedded index (see
+// WriterOptions.EmbedIndex). w must be positioned just after the last
+// member described by idx, for instance after a call to Concat.
+func WriteEmbeddedIndex(w io.Writer, idx *Index) error {
+	return writeIndexMembers(w, idx)
+}
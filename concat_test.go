@@ -0,0 +1,85 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestConcat(t *testing.T) {
+	data := loadDivina(t)
+
+	// Three multi-gzips, with an Offset recorded in each one
+	var srcs []io.ReadSeeker
+	var offs []Offset
+	parts := [][]byte{data[:200000], data[200000:300000], data[300000:]}
+	for i, part := range parts {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelOptions(&buf, -1, 16384, &WriterOptions{EmbedIndex: i != 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(part[:50000]); err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, w.Offset())
+		if _, err := w.Write(part[50000:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, bytes.NewReader(buf.Bytes()))
+	}
+
+	var out bytes.Buffer
+	idx, base, err := Concat(&out, srcs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEmbeddedIndex(&out, idx); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Size() != int64(len(data)) {
+		t.Fatal("invalid size:", idx.Size())
+	}
+
+	eidx, err := ReadEmbeddedIndex(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := eidx.Verify(bytes.NewReader(out.Bytes()[:idx.CompressedSize()])); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := 0
+	for i, o := range offs {
+		o.Block += base[i]
+		if err := rd.SeekOffset(o); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1000)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[pos+50000:pos+51000]) {
+			t.Errorf("invalid data at rebased offset %v", o)
+		}
+		pos += len(parts[i])
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(gz)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Error("invalid concatenated data:", err)
+	}
+}
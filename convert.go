@@ -13,6 +13,7 @@ type ConvertMode int
 const (
 	ConvertNormal ConvertMode = iota
 	ConvertRsyncable
+	ConvertFastCDC
 )
 
 var (
@@ -20,7 +21,8 @@ var (
 )
 
 // Convert a whole gzip file into a multi-gzip file. mode can be used to
-// select between using a normal writer, or the rsync-friendly writer.
+// select between using a normal writer, the rsync-friendly writer, or the
+// FastCDC writer.
 func Convert(w io.Writer, r io.Reader, mode ConvertMode) error {
 
 	// We want to match the same algorithm originally used, to preserve
@@ -44,6 +46,8 @@ func Convert(w io.Writer, r io.Reader, mode ConvertMode) error {
 		oz, _ = NewWriterLevel(w, comprlevel, DefaultBlockSize)
 	case ConvertRsyncable:
 		oz, _ = NewWriterLevelRsyncable(w, comprlevel)
+	case ConvertFastCDC:
+		oz, _ = NewWriterLevelFastCDC(w, comprlevel, nil)
 	default:
 		return errInvalidConvertMode
 	}
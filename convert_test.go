@@ -7,7 +7,7 @@ import (
 )
 
 func TestConvert(t *testing.T) {
-	for _, mode := range []ConvertMode{ConvertNormal, ConvertRsyncable} {
+	for _, mode := range []ConvertMode{ConvertNormal, ConvertRsyncable, ConvertFastCDC} {
 
 		f, err := os.Open("testdata/divina.txt.gz")
 		if err != nil {
@@ -26,7 +26,9 @@ func TestConvert(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		w.Close()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
 
 		f2, err := os.Open(w.Name())
 		if err != nil {
@@ -29,7 +29,7 @@ func IsProbablyMultiGzip(r io.ReadSeeker, peeksize int64) bool {
 	defer gz.Close()
 
 	n, err := io.CopyN(ioutil.Discard, gz, peeksize)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return false
 	}
 	if n < peeksize {
@@ -1,6 +1,7 @@
 package multigz
 
 import (
+	"bytes"
 	"os"
 	"testing"
 )
@@ -26,3 +27,21 @@ func TestIsMultiGzip(t *testing.T) {
 		t.Error("divina2.txt.gz not detected as multigz but it is")
 	}
 }
+
+func TestIsMultiGzipShort(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriterLevel(&buf, 6, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("shorter than a single block")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsProbablyMultiGzip(bytes.NewReader(buf.Bytes()), DefaultPeekSize) {
+		t.Error("short multigz not detected as multigz")
+	}
+}
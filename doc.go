@@ -19,8 +19,17 @@
 // this library assumes this use-case. Both the Reader and the Writer types
 // have a Offset() method that returns a Offset function, that represents a
 // "pointer" to the current position in the decompressed stream. Reader then
-// also has a Seek() method that received an Offset as argument, and seeks to
-// that point.
+// also has a SeekOffset() method that receives an Offset as argument, and
+// seeks to that point.
+//
+// Reader also implements the standard io.Seeker interface, over absolute
+// positions in the decompressed stream. To do so, it uses an Index that
+// lists where each gzip member begins; see BuildIndex(). An Index can be
+// saved to disk with Index.WriteTo() and loaded back with ReadIndex(); the
+// command line tool stores it next to the compressed file, with the .gzi
+// extension. Alternatively, the Writers can embed the index at the end of
+// the multi-gzip itself (see WriterOptions.EmbedIndex), within a gzip member
+// that is ignored by other decompressors.
 //
 // Basically, we support two main scenarios:
 //
@@ -28,15 +37,21 @@
 //     then change it to use multigz.Writer and, as you reach the points where
 //     you will need to seek back to, call Offset() and store the offsets into
 //     a data structure (that you can even marshal to disk if you want, like an
-//     index). Then, open the multi-gzip with multigz.Reader and use Seek to
-//     seek at one of previosly-generated offsets.
+//     index). Then, open the multi-gzip with multigz.Reader and use
+//     SeekOffset to seek at one of previosly-generated offsets.
 //
 //   * If your application receives an already-compressed multi-gzip, open it
 //     with multigz.Reader and scans it. When you reach points that you
 //     might need to seek at later, call Offset() and store the Offset.
-//     Afterwards, you can call Seek() at any time on the same Reader object
-//     to seek back to the saved positions. You can serialize the Offsets
-//     to disk so skip the initial indexing phase for the same file.
+//     Afterwards, you can call SeekOffset() at any time on the same Reader
+//     object to seek back to the saved positions. You can serialize the
+//     Offsets to disk so skip the initial indexing phase for the same file.
+//
+// If you cannot rewrite an ordinary gzip file as a multi-gzip, you can still
+// access it randomly through an AccessReader, which resumes decompression
+// from access points saved while scanning the file once (see
+// BuildAccessIndex). This is slower, and the index is much bigger, as each
+// access point holds 32 KiB of decompressed data.
 //
 //
 // Command line tool
@@ -53,6 +68,9 @@
 //
 //      $ tar c <directory> | multigz -c > archive.tar.gz
 //
+// Single files can then be extracted from the archive without decompressing
+// the whole of it, with "multigz --extract" or the tarindex subpackage.
+//
 //
 // Description of multi-gzip
 //
@@ -75,4 +93,10 @@
 // a valid gzip file, compatible with all existing gzip libraries and tools,
 // but it can be efficiently seeked by knowing in advance where each internal
 // gzip file begins.
+//
+// To find out where each internal gzip file begins without decompressing
+// it, the writers of this package store the compressed length of each gzip
+// member in an extra field of its header (like BGZF and dictzip do). Extra
+// fields are part of the gzip specification, and they are ignored by
+// decompressors that do not know about them.
 package multigz
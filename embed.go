@@ -0,0 +1,190 @@
+package multigz
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The block index can be embedded at the end of a multi-gzip, within one or
+// more additional gzip members with an empty payload. The serialized index
+// (in the same format written by Index.WriteTo) is split into chunks, each
+// one stored in a FEXTRA subfield with ID "MI" of an index member. The last
+// index member also contains a subfield with ID "ML", whose data is the
+// offset of the first index member as a little-endian uint64. Like all
+// members written by multigz, index members also carry a size hint.
+//
+// Since the index members contain no data, gzip-compatible decompressors
+// just skip them; on the other hand, multigz can find the index by looking
+// at the last bytes of the file, as the index member always ends with the
+// "ML" subfield followed by a fixed empty deflate stream and gzip trailer.
+const (
+	maxIndexChunk   = 0xffff - sizeHintLength - 4 - 12
+	indexTailLength = 12 + len(emptyDeflateTail)
+)
+
+// Empty final deflate block (fixed huffman), followed by the gzip trailer of
+// an empty stream (CRC-32 and length both zero).
+const emptyDeflateTail = "\x03\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+var (
+	errNoEmbeddedIndex = errors.New("the multi-gzip does not contain an embedded index")
+)
+
+// writeIndexMembers serializes idx into one or more empty gzip members, and
+// writes them to w. The members must be written just after the last member
+// described by the index.
+func writeIndexMembers(w io.Writer, idx *Index) error {
+	var payload bytes.Buffer
+	if _, err := idx.WriteTo(&payload); err != nil {
+		return err
+	}
+
+	var loc [8]byte
+	binary.LittleEndian.PutUint64(loc[:], uint64(idx.CompressedSize()))
+
+	data := payload.Bytes()
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > maxIndexChunk {
+			chunk = chunk[:maxIndexChunk]
+		}
+		data = data[len(chunk):]
+
+		extra := appendSubfield(newSizeHint(), 'M', 'I', chunk)
+		if len(data) == 0 {
+			extra = appendSubfield(extra, 'M', 'L', loc[:])
+		}
+
+		member := []byte{gzipID1, gzipID2, gzipDeflate, flagExtra, 0, 0, 0, 0, 0, 255,
+			byte(len(extra)), byte(len(extra) >> 8)}
+		member = append(member, extra...)
+		member = append(member, emptyDeflateTail...)
+		patchSizeHint(member)
+		if _, err := w.Write(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadEmbeddedIndex reads the block index embedded at the end of the
+// multi-gzip r, as written by writers created with the EmbedIndex option.
+// It returns an error if r does not contain an embedded index, and
+// ErrStaleIndex if the first or the last member it describes does not
+// match r. The current position of r is not preserved.
+func ReadEmbeddedIndex(r io.ReadSeeker) (*Index, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(indexTailLength) {
+		return nil, errNoEmbeddedIndex
+	}
+	if _, err := r.Seek(size-int64(indexTailLength), io.SeekStart); err != nil {
+		return nil, err
+	}
+	var tail [indexTailLength]byte
+	if _, err := io.ReadFull(r, tail[:]); err != nil {
+		return nil, err
+	}
+	if string(tail[12:]) != emptyDeflateTail || tail[0] != 'M' || tail[1] != 'L' ||
+		binary.LittleEndian.Uint16(tail[2:4]) != 8 {
+		return nil, errNoEmbeddedIndex
+	}
+	loc := int64(binary.LittleEndian.Uint64(tail[4:12]))
+	if loc < 0 || loc >= size {
+		return nil, errNoEmbeddedIndex
+	}
+
+	if _, err := r.Seek(loc, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(io.LimitReader(r, size-loc))
+	var payload []byte
+	for {
+		extra, _, err := readHeader(br)
+		if err != nil {
+			return nil, errNoEmbeddedIndex
+		}
+		payload = append(payload, subfield(extra, 'M', 'I')...)
+
+		var tail [len(emptyDeflateTail)]byte
+		if _, err := io.ReadFull(br, tail[:]); err != nil || string(tail[:]) != emptyDeflateTail {
+			return nil, errNoEmbeddedIndex
+		}
+		if subfield(extra, 'M', 'L') != nil {
+			break
+		}
+	}
+
+	idx, err := ReadIndex(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if idx.CompressedSize() != loc {
+		return nil, errInvalidIndex
+	}
+
+	// The index members survive tools that rewrite the data members
+	// without knowing about them: check that the first and the last
+	// member described by the index are really there.
+	if n := len(idx.Members); n > 0 {
+		if err := checkMember(r, &idx.Members[0]); err != nil {
+			return nil, err
+		}
+		if err := checkMember(r, &idx.Members[n-1]); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// checkMember verifies that a gzip member described by m begins at m.Block
+// in r, and that its trailer matches the CRC-32 and size of m. It returns
+// ErrStaleIndex if it does not.
+func checkMember(r io.ReadSeeker, m *Member) error {
+	if m.BlockSize < 18 {
+		return ErrStaleIndex
+	}
+	if _, err := r.Seek(m.Block, io.SeekStart); err != nil {
+		return err
+	}
+	var magic [3]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return err
+	}
+	if magic != [3]byte{gzipID1, gzipID2, gzipDeflate} {
+		return ErrStaleIndex
+	}
+
+	if _, err := r.Seek(m.Block+m.BlockSize-8, io.SeekStart); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(trailer[0:4]) != m.CRC32 ||
+		binary.LittleEndian.Uint32(trailer[4:8]) != uint32(m.Size) {
+		return ErrStaleIndex
+	}
+	return nil
+}
+
+// loadEmbeddedIndex returns the index embedded in r, if any, preserving the
+// current position of r. Any error is ignored, as the embedded index is
+// just an optimization.
+func loadEmbeddedIndex(r io.ReadSeeker) *Index {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	idx, _ := ReadEmbeddedIndex(r)
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return nil
+	}
+	return idx
+}
@@ -0,0 +1,120 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEmbeddedIndex(t *testing.T) {
+	data := loadDivina(t)
+
+	for _, mode := range []ConvertMode{ConvertNormal, ConvertRsyncable} {
+		var buf bytes.Buffer
+		var w Writer
+		var err error
+		opts := &WriterOptions{EmbedIndex: true}
+		if mode == ConvertNormal {
+			// Use small blocks to force the index to span multiple
+			// members.
+			w, err = NewWriterLevelOptions(&buf, -1, 64, opts)
+		} else {
+			w, err = NewWriterLevelRsyncableOptions(&buf, -1, opts)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The embedded index must be transparent to gzip
+		gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha1.New()
+		if _, err := io.Copy(hash, gz); err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != "810d873f4a55619450f6e2550b8ca0f6c2bd0baf" {
+			t.Error("invalid hash for decompressed stream")
+		}
+
+		idx, err := ReadEmbeddedIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx.Size() != int64(len(data)) {
+			t.Error("invalid size in embedded index:", idx.Size())
+		}
+		if idx.CompressedSize() >= int64(buf.Len()) {
+			t.Error("invalid compressed size in embedded index:", idx.CompressedSize())
+		}
+
+		// Check that the index matches the one built by scanning the
+		// members (excluding the index members themselves).
+		scan, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range idx.Members {
+			if scan.Members[i] != m {
+				t.Fatalf("member %d differs: %+v %+v", i, m, scan.Members[i])
+			}
+		}
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.idx != nil {
+			t.Fatal("embedded index loaded before the first Seek")
+		}
+		pos := int64(len(data) / 3)
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if r.idx == nil || len(r.idx.Members) != len(idx.Members) {
+			t.Fatal("embedded index not loaded by Seek")
+		}
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, data[pos:]) {
+			t.Error("invalid data after seek")
+		}
+		if end, err := r.Seek(0, io.SeekCurrent); err != nil || end != int64(len(data)) {
+			t.Error("invalid position at end of stream:", end, err)
+		}
+
+		// An embedded index that does not match the first or the last
+		// member must be rejected.
+		first, last := idx.Members[0], idx.Members[len(idx.Members)-1]
+		for _, pos := range []int64{first.Block, last.Block + last.BlockSize - 8} {
+			comp := append([]byte(nil), buf.Bytes()...)
+			comp[pos] ^= 0xff
+			if _, err := ReadEmbeddedIndex(bytes.NewReader(comp)); err != ErrStaleIndex {
+				t.Error("corrupted embedded index not detected:", pos, err)
+			}
+		}
+	}
+
+	f, err := os.Open("testdata/divina.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := ReadEmbeddedIndex(f); err == nil {
+		t.Error("embedded index found in a plain gzip file")
+	}
+}
@@ -0,0 +1,74 @@
+package multigz
+
+import "io"
+
+// GzipWriterFastCDC is a Writer that segments the multi-gzip using FastCDC,
+// a content-defined chunking algorithm. Like the rsyncable writer, the
+// segmenting points depend only on the content, so they are stable across
+// insertions and deletions in the uncompressed stream; moreover, FastCDC
+// uses normalized chunking to keep the block size close to the average,
+// which makes it a good fit for storing each gzip member in a deduplicating
+// store. Create it with NewWriterLevelFastCDC.
+type GzipWriterFastCDC struct {
+	GzipWriterRsyncable
+}
+
+// Create a new compressing writer that will generate a multi-gzip, segmenting
+// the compressed stream with FastCDC. The block sizes can be configured with
+// the MinBlockSize, AvgBlockSize and MaxBlockSize options; by default, blocks
+// are DefaultBlockSize long on average, and between a fourth and four times
+// that. Other segmenting options (Hash and WindowSize) are ignored.
+func NewWriterLevelFastCDC(w io.Writer, level int, opts *WriterOptions) (Writer, error) {
+	fw := new(GzipWriterFastCDC)
+	if opts != nil {
+		fw.opts = *opts
+	}
+	if fw.opts.AvgBlockSize == 0 {
+		fw.opts.AvgBlockSize = DefaultBlockSize
+	}
+	if fw.opts.MinBlockSize == 0 {
+		fw.opts.MinBlockSize = fw.opts.AvgBlockSize / 4
+	}
+	if fw.opts.MaxBlockSize == 0 {
+		fw.opts.MaxBlockSize = fw.opts.AvgBlockSize * 4
+	}
+	hash := &fastcdcRoller{
+		avg:   fw.opts.AvgBlockSize,
+		maskS: gearMask(fw.opts.AvgBlockSize << 2),
+		maskL: gearMask(fw.opts.AvgBlockSize >> 2),
+	}
+	if err := fw.init(w, level, hash); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// fastcdcRoller implements FastCDC's normalized chunking over the gear hash:
+// before reaching the average block size, a boundary is searched with a
+// stricter mask (two more bits), while after it a looser mask (two less
+// bits) is used, so that the block size distribution is concentrated around
+// the average. The minimum and maximum block sizes are enforced by the
+// writer.
+type fastcdcRoller struct {
+	gearRoller
+	n            int
+	avg          int
+	maskS, maskL uint64
+}
+
+func (r *fastcdcRoller) reset() {
+	r.gearRoller.reset()
+	r.n = 0
+}
+
+func (r *fastcdcRoller) roll(b byte) {
+	r.gearRoller.roll(b)
+	r.n++
+}
+
+func (r *fastcdcRoller) split() bool {
+	if r.n < r.avg {
+		return r.h&r.maskS == 0
+	}
+	return r.h&r.maskL == 0
+}
@@ -0,0 +1,142 @@
+package multigz
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+
+	flagHdrCrc  = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+// Each member written by multigz carries its own compressed length in a
+// FEXTRA subfield with ID "MS" (as a little-endian uint32), similarly to what
+// BGZF and dictzip do. This allows to find all the members of a file by just
+// reading their headers, without decompressing them. Since the length is
+// known only after the member has been compressed, the writers generate it
+// in memory with a placeholder, and then patch it before writing it out.
+// If the size of its blocks is not bounded (see WriterOptions.MaxBlockSize),
+// the rsyncable writer streams out the members that grow too big to keep
+// them in memory, leaving a zero size hint, which means that it is missing.
+const (
+	sizeHintLength = 4 + 4
+
+	// Offset of the size hint within a member, when it is the first
+	// subfield of the FEXTRA field.
+	sizeHintOffset = 10 + 2 + 4
+)
+
+var (
+	errInvalidHeader = errors.New("invalid gzip header")
+	errNoSizeHint    = errors.New("gzip member without size hint")
+)
+
+// readHeader parses the header of a gzip member from r, and returns the
+// content of its FEXTRA field (nil if it is missing) and the length of the
+// header in bytes. The compression library does not expose the FEXTRA field
+// of the members after the first one, nor the length of the header, so we
+// need to parse it ourselves.
+func readHeader(r *bufio.Reader) (extra []byte, n int64, err error) {
+	var hdr [10]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+	if hdr[0] != gzipID1 || hdr[1] != gzipID2 || hdr[2] != gzipDeflate {
+		return nil, 0, errInvalidHeader
+	}
+	n = 10
+	flg := hdr[3]
+
+	if flg&flagExtra != 0 {
+		var xlen [2]byte
+		if _, err = io.ReadFull(r, xlen[:]); err != nil {
+			return nil, 0, err
+		}
+		extra = make([]byte, binary.LittleEndian.Uint16(xlen[:]))
+		if _, err = io.ReadFull(r, extra); err != nil {
+			return nil, 0, err
+		}
+		n += 2 + int64(len(extra))
+	}
+	for _, f := range []byte{flagName, flagComment} {
+		if flg&f != 0 {
+			s, err := r.ReadSlice(0)
+			if err == bufio.ErrBufferFull {
+				// Very long names; skip them the slow way
+				for err == bufio.ErrBufferFull {
+					n += int64(len(s))
+					s, err = r.ReadSlice(0)
+				}
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			n += int64(len(s))
+		}
+	}
+	if flg&flagHdrCrc != 0 {
+		if _, err = r.Discard(2); err != nil {
+			return nil, 0, err
+		}
+		n += 2
+	}
+	return extra, n, nil
+}
+
+// subfield returns the data of the subfield identified by si1 and si2 within
+// a FEXTRA field, or nil if it is not present.
+func subfield(extra []byte, si1, si2 byte) []byte {
+	for len(extra) >= 4 {
+		sz := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+sz {
+			break
+		}
+		if extra[0] == si1 && extra[1] == si2 {
+			return extra[4 : 4+sz]
+		}
+		extra = extra[4+sz:]
+	}
+	return nil
+}
+
+// newSizeHint returns a FEXTRA field containing a placeholder for the size
+// hint, to be patched later by patchSizeHint.
+func newSizeHint() []byte {
+	return appendSubfield(nil, 'M', 'S', make([]byte, 4))
+}
+
+// patchSizeHint stores the length of the gzip member into the placeholder
+// created by newSizeHint. Members too large to be described by the size
+// hint get a zero length, which readers ignore.
+func patchSizeHint(member []byte) {
+	sz := uint32(len(member))
+	if int64(len(member)) != int64(sz) {
+		sz = 0
+	}
+	binary.LittleEndian.PutUint32(member[sizeHintOffset:], sz)
+}
+
+// sizeHint returns the compressed length of a gzip member stored in its
+// FEXTRA field, or errNoSizeHint if it is missing.
+func sizeHint(extra []byte) (int64, error) {
+	hint := subfield(extra, 'M', 'S')
+	if len(hint) != 4 || binary.LittleEndian.Uint32(hint) == 0 {
+		return 0, errNoSizeHint
+	}
+	return int64(binary.LittleEndian.Uint32(hint)), nil
+}
+
+// appendSubfield appends a subfield to a FEXTRA field.
+func appendSubfield(extra []byte, si1, si2 byte, data []byte) []byte {
+	extra = append(extra, si1, si2, byte(len(data)), byte(len(data)>>8))
+	return append(extra, data...)
+}
@@ -0,0 +1,87 @@
+package multigz
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpHandler serves the decompressed content of a multi-gzip file.
+type httpHandler struct {
+	path string
+
+	// idx is the index of the file as it was at modTime with the given
+	// size; it is loaded again if the file changes.
+	mu      sync.Mutex
+	idx     *Index
+	modTime time.Time
+	size    int64
+}
+
+// NewHTTPHandler returns a http.Handler that serves the decompressed content
+// of the multi-gzip file at path. It supports Range requests (including
+// multiple ranges), answering with 206 or 416 as appropriate, and it only
+// decompresses the members that overlap with the requested ranges. The
+// Content-Type is guessed from the name of the file, without the .gz
+// extension.
+//
+// The block index is loaded at the first request, with LoadIndex, and
+// loaded again whenever the modification time or the size of the file
+// change. If loading fails, the next request tries again.
+func NewHTTPHandler(path string) http.Handler {
+	return &httpHandler{path: path}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idx, err := h.index(f, fi)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ra, err := NewReaderAt(f, idx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := strings.TrimSuffix(filepath.Base(h.path), ".gz")
+	http.ServeContent(w, req, name, fi.ModTime(), io.NewSectionReader(ra, 0, ra.Size()))
+}
+
+// index returns the block index of f, whose current state is described by
+// fi, loading it if the file changed since the last time.
+func (h *httpHandler) index(f *os.File, fi os.FileInfo) (*Index, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.idx != nil && h.modTime.Equal(fi.ModTime()) && h.size == fi.Size() {
+		return h.idx, nil
+	}
+	idx, err := LoadIndex(f)
+	if err != nil {
+		return nil, err
+	}
+	h.idx, h.modTime, h.size = idx, fi.ModTime(), fi.Size()
+	return idx, nil
+}
@@ -0,0 +1,109 @@
+package multigz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := loadDivina(t)
+	size := strconv.Itoa(len(data))
+
+	h := NewHTTPHandler("testdata/divina2.txt.gz")
+	get := func(rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/divina2.txt.gz", nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Error("invalid full response:", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Error("invalid content type:", ct)
+	}
+
+	rec = get("bytes=100000-300000")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatal("invalid status for range:", rec.Code)
+	}
+	if cr := rec.Header().Get("Content-Range"); cr != "bytes 100000-300000/"+size {
+		t.Error("invalid Content-Range:", cr)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[100000:300001]) {
+		t.Error("invalid range content")
+	}
+
+	rec = get("bytes=-10")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[len(data)-10:]) {
+		t.Error("invalid suffix range:", rec.Code)
+	}
+
+	rec = get("bytes=" + size + "-")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Error("invalid status for unsatisfiable range:", rec.Code)
+	}
+}
+
+func TestHTTPHandlerReload(t *testing.T) {
+	data := loadDivina(t)
+
+	out, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	out.Close()
+
+	h := NewHTTPHandler(out.Name())
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/file", nil))
+		return rec
+	}
+
+	// A failure to load the index must not be permanent
+	if err := ioutil.WriteFile(out.Name(), []byte("not a gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(); rec.Code != http.StatusInternalServerError {
+		t.Error("invalid status for a broken file:", rec.Code)
+	}
+
+	// The index must follow the changes of the file
+	for _, size := range []int{100000, 200000} {
+		var buf bytes.Buffer
+		w, err := NewWriterLevel(&buf, -1, 16384)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data[:size]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(out.Name(), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rec := get()
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data[:size]) {
+			t.Error("invalid response after changing the file:", rec.Code, rec.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package multigz
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// maxDeflateRatio is the maximum compression ratio that deflate can achieve.
+const maxDeflateRatio = 1032
+
+var (
+	errSeekOutOfRange = errors.New("seek position is outside of the decompressed stream")
+)
+
+// Member describes a single gzip member (block) within a multi-gzip file.
+// Block is the offset of the member within the compressed file, and it is
+// the same value that is stored in Offset.Block for all the positions
+// within the member.
+type Member struct {
+	Block     int64  // offset of the member within the compressed file
+	BlockSize int64  // compressed length of the member
+	Start     int64  // offset of the first decompressed byte of the member
+	Size      int64  // decompressed length of the member
+	CRC32     uint32 // checksum of the decompressed data, as per gzip trailer
+}
+
+// Index is the list of the gzip members that make up a multi-gzip file,
+// in file order. It can be used to translate positions within the
+// decompressed stream into Offsets, and vice-versa.
+type Index struct {
+	Members []Member
+}
+
+// BuildIndex scans the whole multi-gzip file r once, and returns an Index
+// describing all the gzip members found in it. The file is scanned from
+// its beginning, irrespective of the current position of r.
+//
+// If all the members carry a size hint in their header (as it happens for
+// the multi-gzips created by this package, except for the rsyncable members
+// bigger than 1 MB without a MaxBlockSize), the index is built by just
+// reading the header and trailer of each member. Otherwise, this requires
+// decompressing the whole file, so it has the same cost of reading it
+// through a Reader. In both cases, the resulting Index can be reused
+// afterwards to seek without scanning the file again.
+func BuildIndex(r io.ReadSeeker) (*Index, error) {
+	if idx, err := walkIndex(r); err == nil {
+		return idx, nil
+	}
+	return scanIndex(r)
+}
+
+// scanIndex builds the index of r by decompressing all its members.
+func scanIndex(r io.ReadSeeker) (*Index, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return scanMembers(r, nil)
+}
+
+// scanMembers builds the index of the multi-gzip read sequentially from r,
+// by decompressing all its members. If lines is not nil, it also appends to
+// it the number of newlines up to the end of each member (see LineIndex).
+func scanMembers(r io.Reader, lines *[]int64) (*Index, error) {
+	var cnt int64
+	cr := &countReader{
+		R:   bufio.NewReader(r),
+		Cnt: &cnt,
+	}
+	gz, err := gzip.NewReader(cr)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	idx := new(Index)
+	var block, start int64
+	var lc lineCounter
+	crc := crc32.NewIEEE()
+	w := io.Writer(crc)
+	if lines != nil {
+		w = io.MultiWriter(crc, &lc)
+	}
+	for {
+		gz.Multistream(false)
+		crc.Reset()
+		n, err := io.Copy(w, gz)
+		if err != nil {
+			return nil, err
+		}
+		if lines != nil {
+			*lines = append(*lines, int64(lc))
+		}
+		idx.Members = append(idx.Members, Member{
+			Block:     block,
+			BlockSize: cnt - block,
+			Start:     start,
+			Size:      n,
+			CRC32:     crc.Sum32(),
+		})
+		block = cnt
+		start += n
+
+		if err := gz.Reset(cr); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return idx, nil
+}
+
+// walkIndex builds the index of r by following the size hints stored in the
+// header of each member. It fails if any member does not have a size hint,
+// or if a size hint does not lead to the beginning of the next member (or to
+// the end of the file). If the last member is incomplete, it returns a
+// *TruncatedError.
+//
+// The decompressed length of each member is read from its trailer, which
+// stores it modulo 4 GiB. walkIndex fails if a member is big enough that it
+// might decompress to 4 GiB or more, as its length would be ambiguous.
+func walkIndex(r io.ReadSeeker) (*Index, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, io.EOF
+	}
+
+	idx := new(Index)
+	br := bufio.NewReaderSize(r, 64)
+	var block, start int64
+	for block < size {
+		if _, err := r.Seek(block, io.SeekStart); err != nil {
+			return nil, err
+		}
+		br.Reset(r)
+		extra, hlen, err := readHeader(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &TruncatedError{Offset: block, Extra: size - block}
+		}
+		if err != nil {
+			return nil, err
+		}
+		bsize, err := sizeHint(extra)
+		if err != nil {
+			return nil, err
+		}
+		if bsize < hlen+8 {
+			return nil, errInvalidHeader
+		}
+		if block+bsize > size {
+			return nil, &TruncatedError{Offset: block, Extra: size - block}
+		}
+		dlen := bsize - hlen - 8
+		if dlen*maxDeflateRatio >= 1<<32 {
+			return nil, errNoSizeHint
+		}
+
+		// Read the trailer, together with the magic of the next member
+		var tail [8 + 2]byte
+		n := len(tail)
+		if block+bsize == size {
+			n = 8
+		}
+		if _, err := r.Seek(block+bsize-8, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, tail[:n]); err != nil {
+			return nil, err
+		}
+		if n > 8 && (tail[8] != gzipID1 || tail[9] != gzipID2) {
+			return nil, errInvalidHeader
+		}
+
+		m := Member{
+			Block:     block,
+			BlockSize: bsize,
+			Start:     start,
+			Size:      int64(binary.LittleEndian.Uint32(tail[4:8])),
+			CRC32:     binary.LittleEndian.Uint32(tail[0:4]),
+		}
+		if m.Size > dlen*maxDeflateRatio {
+			return nil, errInvalidHeader
+		}
+		idx.Members = append(idx.Members, m)
+		block += m.BlockSize
+		start += m.Size
+	}
+	return idx, nil
+}
+
+// Size returns the total length of the decompressed stream.
+func (idx *Index) Size() int64 {
+	if len(idx.Members) == 0 {
+		return 0
+	}
+	last := idx.Members[len(idx.Members)-1]
+	return last.Start + last.Size
+}
+
+// CompressedSize returns the total length of the compressed members.
+func (idx *Index) CompressedSize() int64 {
+	if len(idx.Members) == 0 {
+		return 0
+	}
+	last := idx.Members[len(idx.Members)-1]
+	return last.Block + last.BlockSize
+}
+
+// Offset translates pos, a position in the decompressed stream, into the
+// Offset that can be used to seek at it. The position just past the end of
+// the stream is valid, and corresponds to the end of the last member.
+func (idx *Index) Offset(pos int64) (Offset, error) {
+	if pos < 0 || pos > idx.Size() {
+		return Offset{}, errSeekOutOfRange
+	}
+	i := idx.find(pos)
+	if i == len(idx.Members) {
+		if i == 0 {
+			return Offset{}, nil
+		}
+		i--
+	}
+	m := &idx.Members[i]
+	return Offset{Block: m.Block, Off: pos - m.Start}, nil
+}
+
+// Pos translates an Offset into the corresponding position in the
+// decompressed stream. It returns an error if the Offset does not point
+// within one of the members of the index.
+func (idx *Index) Pos(o Offset) (int64, error) {
+	// Offsets past the last member (eg: within an embedded index) are
+	// at the end of the decompressed stream.
+	if o.Block >= idx.CompressedSize() && o.Off == 0 {
+		return idx.Size(), nil
+	}
+	m := idx.member(o.Block)
+	if m == nil || o.Off < 0 {
+		return 0, errWrongOffset
+	}
+	return m.Start + o.Off, nil
+}
+
+// member returns the member at offset block of the compressed file, or nil
+// if no member starts there.
+func (idx *Index) member(block int64) *Member {
+	i := sort.Search(len(idx.Members), func(i int) bool {
+		return idx.Members[i].Block >= block
+	})
+	if i == len(idx.Members) || idx.Members[i].Block != block {
+		return nil
+	}
+	return &idx.Members[i]
+}
+
+// find returns the index of the member containing the decompressed position
+// pos, or len(idx.Members) if pos is past the end of the stream. Empty
+// members are never returned.
+func (idx *Index) find(pos int64) int {
+	return sort.Search(len(idx.Members), func(i int) bool {
+		m := &idx.Members[i]
+		return m.Start+m.Size > pos
+	})
+}
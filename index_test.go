@@ -0,0 +1,281 @@
+package multigz
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBuildIndex(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	idx, err := BuildIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Members) < 2 {
+		t.Fatal("too few members found:", len(idx.Members))
+	}
+
+	var block, start int64
+	for i, m := range idx.Members {
+		if m.Block != block || m.Start != start {
+			t.Errorf("member %d is not contiguous: %+v", i, m)
+		}
+		block += m.BlockSize
+		start += m.Size
+	}
+
+	fi, _ := f.Stat()
+	if idx.CompressedSize() != fi.Size() {
+		t.Error("invalid compressed size:", idx.CompressedSize(), fi.Size())
+	}
+	if idx.Size() != 618423 {
+		t.Error("invalid decompressed size:", idx.Size())
+	}
+
+	// Decompressing the members one by one must give back the whole stream
+	f.Seek(0, io.SeekStart)
+	gz, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.New()
+	for _, m := range idx.Members {
+		if err := gz.SeekOffset(Offset{Block: m.Block}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(hash, gz, m.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != "810d873f4a55619450f6e2550b8ca0f6c2bd0baf" {
+		t.Error("invalid hash for decompressed members")
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	idx, err := BuildIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := idx.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Error("invalid length returned by WriteTo:", n, buf.Len())
+	}
+	data := buf.Bytes()
+
+	idx2, err := ReadIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(idx, idx2) {
+		t.Error("index changed after serialization")
+	}
+	if err := idx2.Verify(f); err != nil {
+		t.Error("verify failed:", err)
+	}
+
+	// Any corruption must be detected
+	for i := range data {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0x40
+		if _, err := ReadIndex(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("corruption at byte %d not detected", i)
+		}
+	}
+	if _, err := ReadIndex(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("truncated index not detected")
+	}
+
+	// The index of a different file must be rejected
+	f2, err := os.Open("testdata/divina.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if err := idx2.Verify(f2); err != ErrStaleIndex {
+		t.Error("stale index not detected:", err)
+	}
+}
+
+func TestWalkIndex(t *testing.T) {
+	f, err := os.Open("testdata/divina.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Files not generated by multigz do not have size hints
+	if _, err := walkIndex(f); err != errNoSizeHint {
+		t.Error("size hints found in a plain gzip file:", err)
+	}
+
+	for _, mode := range []ConvertMode{ConvertNormal, ConvertRsyncable, ConvertFastCDC} {
+		f.Seek(0, io.SeekStart)
+		var buf bytes.Buffer
+		if err := Convert(&buf, f, mode); err != nil {
+			t.Fatal(err)
+		}
+
+		walk, err := walkIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scan, err := scanIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(walk.Members) < 2 || !reflect.DeepEqual(walk, scan) {
+			t.Error("index built from size hints does not match")
+		}
+
+		// A wrong size hint must be detected, and BuildIndex must fall
+		// back to scanning the file.
+		comp := append([]byte(nil), buf.Bytes()...)
+		comp[walk.Members[1].Block+sizeHintOffset] += 2
+		if _, err := walkIndex(bytes.NewReader(comp)); err == nil {
+			t.Error("corrupted size hint not detected")
+		}
+		idx, err := BuildIndex(bytes.NewReader(comp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(idx, scan) {
+			t.Error("invalid index built from corrupted size hints")
+		}
+	}
+
+	// Unbounded rsyncable members that are too big are streamed out
+	// without a size hint, so the file must be scanned.
+	comp := compressUnhinted(t)
+	if _, err := walkIndex(bytes.NewReader(comp)); err != errNoSizeHint {
+		t.Error("size hints found in streamed rsyncable members:", err)
+	}
+	idx, err := BuildIndex(bytes.NewReader(comp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Size() != 3*maxBufferedMemberSize || idx.Members[0].BlockSize <= maxBufferedMemberSize {
+		t.Error("invalid index of streamed rsyncable members:", idx.Members)
+	}
+}
+
+// compressUnhinted returns a multi-gzip generated by the rsyncable writer,
+// whose first member is too big to store its size hint.
+func compressUnhinted(t testing.TB) []byte {
+	data := make([]byte, 3*maxBufferedMemberSize)
+	rand.New(rand.NewSource(1)).Read(data[:2*maxBufferedMemberSize])
+
+	var buf bytes.Buffer
+	w, err := NewWriterLevelRsyncableOptions(&buf, -1, &WriterOptions{
+		MinBlockSize: 2 * maxBufferedMemberSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadIndex(t *testing.T) {
+	data := loadDivina(t)
+
+	out, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer os.Remove(out.Name() + ".gzi")
+	defer out.Close()
+
+	w, err := NewWriterLevel(out, -1, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := BuildIndex(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale index file is ignored
+	stale := &Index{Members: want.Members[:1]}
+	gzi, err := os.Create(out.Name() + ".gzi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stale.WriteTo(gzi); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzi.Close(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndex(out)
+	if err != nil || !reflect.DeepEqual(idx, want) {
+		t.Error("stale index file not detected:", err)
+	}
+
+	// An up-to-date index file is used
+	gzi, err = os.Create(out.Name() + ".gzi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := want.WriteTo(gzi); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzi.Close(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = LoadIndex(out)
+	if err != nil || !reflect.DeepEqual(idx, want) {
+		t.Error("invalid index loaded from index file:", err)
+	}
+
+	// The embedded index is used, if present
+	if err := out.Truncate(stale.CompressedSize()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.Seek(stale.CompressedSize(), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEmbeddedIndex(out, stale); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = LoadIndex(out)
+	if err != nil || !reflect.DeepEqual(idx, stale) {
+		t.Error("embedded index not used:", err)
+	}
+}
@@ -0,0 +1,246 @@
+package multigz
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Binary format of an index file (conventionally stored next to the
+// multi-gzip, with the ".gzi" extension). All integers are either unsigned
+// varints or little-endian 32-bit words:
+//
+//	magic     "MGZI"
+//	version   byte (currently 1)
+//	filesize  uvarint: length of the multi-gzip file
+//	checksum  uint32: CRC-32 of all member trailers of the multi-gzip file
+//	count     uvarint: number of members
+//	members   count times:
+//	  gap       uvarint: distance of the member from the end of the previous one
+//	  blocksize uvarint: compressed length of the member
+//	  size      uvarint: decompressed length of the member
+//	  crc32     uint32: CRC-32 of the decompressed data of the member
+//	crc       uint32: CRC-32 of all the preceding bytes of the index file
+//
+// The checksum of the member trailers (the CRC-32 and the length of the
+// decompressed data that gzip stores at the end of each member) is used to
+// reject indices that do not belong to a multi-gzip file, without having to
+// read it all.
+const (
+	indexMagic   = "MGZI"
+	indexVersion = 1
+)
+
+var (
+	// ErrStaleIndex is returned by Index.Verify when the index does not
+	// describe the specified multi-gzip file (for instance, because the
+	// file was modified after the index was generated).
+	ErrStaleIndex = errors.New("the index does not match the multi-gzip file")
+
+	errInvalidIndex = errors.New("invalid or corrupted index file")
+)
+
+type crcWriter struct {
+	W   io.Writer
+	Crc hash.Hash32
+}
+
+func (cw *crcWriter) Write(data []byte) (int, error) {
+	n, err := cw.W.Write(data)
+	cw.Crc.Write(data[:n])
+	return n, err
+}
+
+type crcReader struct {
+	R   *bufio.Reader
+	Crc hash.Hash32
+}
+
+func (cr *crcReader) Read(data []byte) (int, error) {
+	n, err := cr.R.Read(data)
+	cr.Crc.Write(data[:n])
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	ch, err := cr.R.ReadByte()
+	if err == nil {
+		cr.Crc.Write([]byte{ch})
+	}
+	return ch, err
+}
+
+// checksum computes the checksum of the member trailers described by the
+// index.
+func (idx *Index) checksum() uint32 {
+	crc := crc32.NewIEEE()
+	var trailer [8]byte
+	for _, m := range idx.Members {
+		binary.LittleEndian.PutUint32(trailer[0:4], m.CRC32)
+		binary.LittleEndian.PutUint32(trailer[4:8], uint32(m.Size))
+		crc.Write(trailer[:])
+	}
+	return crc.Sum32()
+}
+
+// WriteTo serializes the index into w, using a compact binary format that
+// can be read back with ReadIndex. It implements io.WriterTo.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{Writer: w}
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(&crcWriter{W: cw, Crc: crc})
+
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(v int64) {
+		n := binary.PutUvarint(buf[:], uint64(v))
+		bw.Write(buf[:n])
+	}
+	uint32le := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:4], v)
+		bw.Write(buf[:4])
+	}
+
+	bw.WriteString(indexMagic)
+	bw.WriteByte(indexVersion)
+	uvarint(idx.CompressedSize())
+	uint32le(idx.checksum())
+	uvarint(int64(len(idx.Members)))
+	var end int64
+	for _, m := range idx.Members {
+		uvarint(m.Block - end)
+		uvarint(m.BlockSize)
+		uvarint(m.Size)
+		uint32le(m.CRC32)
+		end = m.Block + m.BlockSize
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.off, err
+	}
+
+	binary.LittleEndian.PutUint32(buf[:4], crc.Sum32())
+	_, err := cw.Write(buf[:4])
+	return cw.off, err
+}
+
+// indexDecoder reads the fields of an index file, remembering the first
+// error that occurs so that it can be checked only once at the end.
+type indexDecoder struct {
+	r   *crcReader
+	err error
+}
+
+func (d *indexDecoder) uvarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil || v > 1<<62 {
+		d.err = errInvalidIndex
+	}
+	return int64(v)
+}
+
+func (d *indexDecoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		d.err = errInvalidIndex
+	}
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+// ReadIndex reads an index previously serialized with Index.WriteTo. Since
+// the index is normally stored separately from the multi-gzip it refers to,
+// it is advisable to call Index.Verify before using it.
+func ReadIndex(r io.Reader) (*Index, error) {
+	d := &indexDecoder{r: &crcReader{R: bufio.NewReader(r), Crc: crc32.NewIEEE()}}
+
+	var magic [4]byte
+	if _, err := io.ReadFull(d.r, magic[:]); err != nil || string(magic[:]) != indexMagic {
+		return nil, errInvalidIndex
+	}
+	if v, err := d.r.ReadByte(); err != nil || v != indexVersion {
+		return nil, errInvalidIndex
+	}
+	fsize := d.uvarint()
+	checksum := d.uint32()
+	count := d.uvarint()
+
+	idx := new(Index)
+	var end, start int64
+	for i := int64(0); i < count && d.err == nil; i++ {
+		m := Member{Block: end + d.uvarint(), Start: start}
+		m.BlockSize = d.uvarint()
+		m.Size = d.uvarint()
+		m.CRC32 = d.uint32()
+		idx.Members = append(idx.Members, m)
+		end = m.Block + m.BlockSize
+		start += m.Size
+	}
+
+	sum := d.r.Crc.Sum32()
+	if d.uint32() != sum || d.err != nil {
+		return nil, errInvalidIndex
+	}
+	if idx.CompressedSize() != fsize || idx.checksum() != checksum {
+		return nil, errInvalidIndex
+	}
+	return idx, nil
+}
+
+// Verify checks that the index describes the multi-gzip file r, returning
+// ErrStaleIndex if it does not. Only the trailers of the gzip members are
+// read, so this is much faster than building the index again.
+func (idx *Index) Verify(r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size != idx.CompressedSize() {
+		return ErrStaleIndex
+	}
+
+	var trailer [8]byte
+	for _, m := range idx.Members {
+		if _, err := r.Seek(m.Block+m.BlockSize-8, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, trailer[:]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(trailer[0:4]) != m.CRC32 ||
+			binary.LittleEndian.Uint32(trailer[4:8]) != uint32(m.Size) {
+			return ErrStaleIndex
+		}
+	}
+	return nil
+}
+
+// LoadIndex returns the block index of the multi-gzip file f, getting it
+// from the cheapest source available, in this order:
+//
+//  - the index embedded in the file, if any (see ReadEmbeddedIndex);
+//  - the index file next to it, named f.Name()+".gzi", if it exists and it
+//    is up-to-date (see Index.Verify);
+//  - otherwise, the index is built from the file itself (see BuildIndex).
+//
+// The current position of f is not preserved.
+func LoadIndex(f *os.File) (*Index, error) {
+	if idx, err := ReadEmbeddedIndex(f); err == nil {
+		return idx, nil
+	}
+	if gzi, err := os.Open(f.Name() + ".gzi"); err == nil {
+		defer gzi.Close()
+		idx, err := ReadIndex(bufio.NewReader(gzi))
+		if err == nil && idx.Verify(f) == nil {
+			return idx, nil
+		}
+	}
+	return BuildIndex(f)
+}
@@ -0,0 +1,428 @@
+package multigz
+
+import (
+	"bufio"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// This file implements a minimal deflate decoder, used to build the access
+// point index of ordinary gzip files. Go's compress/flate does not report
+// where each deflate block begins (at bit granularity), so we need our own
+// decoder to find the points where decompression can be resumed. It is
+// only used for the initial scan: random accesses are then served by
+// compress/flate, primed with the window saved at the access point.
+
+const (
+	maxCodeBits = 15
+	fastBits    = 9
+	windowSize  = 32768
+)
+
+var (
+	errCorruptDeflate = errors.New("corrupted deflate stream")
+)
+
+// huffman is a canonical Huffman decoding table.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol []uint16
+	// fast decodes codes up to fastBits bits: each entry contains
+	// (symbol << 4) | length, or zero if the code is longer.
+	fast [1 << fastBits]uint16
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	*h = huffman{symbol: make([]uint16, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return errCorruptDeflate
+		}
+	}
+
+	var offs [maxCodeBits + 2]uint16
+	for l := 1; l <= maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	code, idx := 0, 0
+	for l := 1; l <= fastBits; l++ {
+		for i := 0; i < int(h.count[l]); i++ {
+			rev := 0
+			for b := 0; b < l; b++ {
+				rev |= ((code >> uint(b)) & 1) << uint(l-1-b)
+			}
+			for j := rev; j < 1<<fastBits; j += 1 << uint(l) {
+				h.fast[j] = h.symbol[idx]<<4 | uint16(l)
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// Order of the code length code lengths in a dynamic block header
+	clOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLit, fixedDist huffman
+)
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLit.init(lengths[:])
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+	fixedDist.init(lengths[:30])
+}
+
+// inflater decodes a raw deflate stream, keeping track of the exact bit
+// position of each block.
+type inflater struct {
+	r      *bufio.Reader
+	in     int64 // bytes read from r
+	bitbuf uint64
+	bitcnt uint
+
+	// Decompressed data: the last windowSize bytes are always available
+	// before wpos, to resolve back-references.
+	wbuf    [2 * windowSize]byte
+	wpos    int
+	flushed int
+	out     int64
+	crc     hash.Hash32
+
+	lit, dist huffman
+}
+
+func newInflater(r *bufio.Reader, in int64) *inflater {
+	return &inflater{r: r, in: in, crc: crc32.NewIEEE()}
+}
+
+// bitPos returns the position of the next bit to be decoded, as number of
+// bits since the beginning of the input.
+func (f *inflater) bitPos() int64 {
+	return f.in*8 - int64(f.bitcnt)
+}
+
+// window returns the last (up to) 32 KiB of decompressed data.
+func (f *inflater) window() []byte {
+	n := windowSize
+	if int64(n) > f.out {
+		n = int(f.out)
+	}
+	return append([]byte(nil), f.wbuf[f.wpos-n:f.wpos]...)
+}
+
+func (f *inflater) need(n uint) error {
+	for f.bitcnt < n {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		f.in++
+		f.bitbuf |= uint64(b) << f.bitcnt
+		f.bitcnt += 8
+	}
+	return nil
+}
+
+func (f *inflater) bits(n uint) (int, error) {
+	if err := f.need(n); err != nil {
+		return 0, err
+	}
+	v := int(f.bitbuf & (1<<n - 1))
+	f.bitbuf >>= n
+	f.bitcnt -= n
+	return v, nil
+}
+
+func (f *inflater) decode(h *huffman) (int, error) {
+	if f.bitcnt < fastBits {
+		// Not finding enough bits is not an error here, as the last
+		// code of the stream can be shorter than fastBits.
+		for f.bitcnt <= 56 {
+			b, err := f.r.ReadByte()
+			if err != nil {
+				break
+			}
+			f.in++
+			f.bitbuf |= uint64(b) << f.bitcnt
+			f.bitcnt += 8
+		}
+	}
+	if f.bitcnt >= fastBits {
+		if e := h.fast[f.bitbuf&(1<<fastBits-1)]; e != 0 {
+			f.bitbuf >>= e & 15
+			f.bitcnt -= uint(e & 15)
+			return int(e >> 4), nil
+		}
+	}
+
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := f.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= b
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate
+}
+
+func (f *inflater) put(b byte) {
+	if f.wpos == len(f.wbuf) {
+		f.crc.Write(f.wbuf[f.flushed:])
+		copy(f.wbuf[:], f.wbuf[windowSize:])
+		f.wpos = windowSize
+		f.flushed = windowSize
+	}
+	f.wbuf[f.wpos] = b
+	f.wpos++
+	f.out++
+}
+
+// block decodes a single deflate block, and returns true if it was the
+// final one.
+func (f *inflater) block() (bool, error) {
+	hdr, err := f.bits(3)
+	if err != nil {
+		return false, err
+	}
+	switch hdr >> 1 {
+	case 0:
+		err = f.stored()
+	case 1:
+		err = f.codes(&fixedLit, &fixedDist)
+	case 2:
+		if err = f.dynamic(); err == nil {
+			err = f.codes(&f.lit, &f.dist)
+		}
+	default:
+		err = errCorruptDeflate
+	}
+	return hdr&1 != 0, err
+}
+
+func (f *inflater) stored() error {
+	f.bitbuf >>= f.bitcnt & 7
+	f.bitcnt &^= 7
+	n, err := f.bits(16)
+	if err != nil {
+		return err
+	}
+	nn, err := f.bits(16)
+	if err != nil {
+		return err
+	}
+	if n != ^nn&0xffff {
+		return errCorruptDeflate
+	}
+	for ; n > 0; n-- {
+		b, err := f.bits(8)
+		if err != nil {
+			return err
+		}
+		f.put(byte(b))
+	}
+	return nil
+}
+
+func (f *inflater) dynamic() error {
+	nlen, err := f.bits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := f.bits(5)
+	if err != nil {
+		return err
+	}
+	ncode, err := f.bits(4)
+	if err != nil {
+		return err
+	}
+	nlen += 257
+	ndist++
+	ncode += 4
+	if nlen > 286 || ndist > 30 {
+		return errCorruptDeflate
+	}
+
+	var lengths [286 + 30]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := f.bits(3)
+		if err != nil {
+			return err
+		}
+		lengths[clOrder[i]] = uint8(l)
+	}
+	var lencode huffman
+	if err := lencode.init(lengths[:19]); err != nil {
+		return err
+	}
+	for i := range lengths[:19] {
+		lengths[i] = 0
+	}
+
+	for i := 0; i < nlen+ndist; {
+		sym, err := f.decode(&lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var l uint8
+		var rep int
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate
+			}
+			l = lengths[i-1]
+			rep, err = f.bits(2)
+			rep += 3
+		case 17:
+			rep, err = f.bits(3)
+			rep += 3
+		default:
+			rep, err = f.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+rep > nlen+ndist {
+			return errCorruptDeflate
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return errCorruptDeflate
+	}
+	if err := f.lit.init(lengths[:nlen]); err != nil {
+		return err
+	}
+	return f.dist.init(lengths[nlen : nlen+ndist])
+}
+
+func (f *inflater) codes(lit, dist *huffman) error {
+	for {
+		sym, err := f.decode(lit)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			f.put(byte(sym))
+			continue
+		}
+		if sym == 256 {
+			return nil
+		}
+
+		sym -= 257
+		if sym >= 29 {
+			return errCorruptDeflate
+		}
+		extra, err := f.bits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + extra
+
+		dsym, err := f.decode(dist)
+		if err != nil {
+			return err
+		}
+		if dsym >= 30 {
+			return errCorruptDeflate
+		}
+		extra, err = f.bits(uint(distExtra[dsym]))
+		if err != nil {
+			return err
+		}
+		d := int(distBase[dsym]) + extra
+		if int64(d) > f.out {
+			return errCorruptDeflate
+		}
+		for ; length > 0; length-- {
+			// put() might move the window, so compute the source
+			// position at every byte.
+			f.put(f.wbuf[f.wpos-d])
+		}
+	}
+}
+
+// trailer reads the gzip trailer after the final block, and verifies it.
+func (f *inflater) trailer() error {
+	f.crc.Write(f.wbuf[f.flushed:f.wpos])
+	f.flushed = f.wpos
+
+	f.bitbuf >>= f.bitcnt & 7
+	f.bitcnt &^= 7
+	crc, err := f.bits(32)
+	if err != nil {
+		return err
+	}
+	size, err := f.bits(32)
+	if err != nil {
+		return err
+	}
+	if uint32(crc) != f.crc.Sum32() || uint32(size) != uint32(f.out) {
+		return errCorruptDeflate
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package multigz
+
+import (
+	"bytes"
+	"io"
+	"sort"
+)
+
+// LineIndex records the number of newlines contained in the members of a
+// multi-gzip, so that it is possible to seek to a given line number of a
+// text file (see Reader.SeekLine) decompressing at most one member.
+type LineIndex struct {
+	Index    *Index
+	Newlines []int64 // number of '\n' bytes up to the end of each member of Index
+}
+
+// lineCounter is an io.Writer that counts the newlines written to it.
+type lineCounter int64
+
+func (lc *lineCounter) Write(data []byte) (int, error) {
+	*lc += lineCounter(bytes.Count(data, []byte{'\n'}))
+	return len(data), nil
+}
+
+// BuildLineIndex decompresses the whole multi-gzip r once, building its
+// Index and counting the newlines in each member. Like BuildIndex, it reads
+// the file from its beginning, irrespective of the current position of r.
+func BuildLineIndex(r io.ReadSeeker) (*LineIndex, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	li := new(LineIndex)
+	idx, err := scanMembers(r, &li.Newlines)
+	if err != nil {
+		return nil, err
+	}
+	li.Index = idx
+	return li, nil
+}
+
+// Lines returns the total number of newlines in the decompressed stream.
+func (li *LineIndex) Lines() int64 {
+	if len(li.Newlines) == 0 {
+		return 0
+	}
+	return li.Newlines[len(li.Newlines)-1]
+}
+
+// SetLineIndex sets the LineIndex used by SeekLine. It is not required to
+// call it, but it avoids decompressing the whole file at the first call to
+// SeekLine.
+func (or *Reader) SetLineIndex(li *LineIndex) {
+	or.lines = li
+	if or.idx == nil {
+		or.idx = li.Index
+	}
+}
+
+// SeekLine moves the reader to the beginning of line n of the decompressed
+// stream, where the first line is line 0. Lines are terminated by '\n'; n
+// can be at most the total number of newlines, which corresponds to the
+// (possibly empty) text after the last newline.
+//
+// If no LineIndex was provided with SetLineIndex, the first call to
+// SeekLine builds one by decompressing the whole file.
+func (or *Reader) SeekLine(n int64) error {
+	if or.lines == nil {
+		li, err := BuildLineIndex(or.r)
+		if err != nil {
+			return err
+		}
+		or.SetLineIndex(li)
+		// See Seek: the underlying reader was moved
+		or.block = -1
+	}
+	if n < 0 || n > or.lines.Lines() {
+		return errSeekOutOfRange
+	}
+	if n == 0 {
+		o, err := or.lines.Index.Offset(0)
+		if err != nil {
+			return err
+		}
+		return or.SeekOffset(o)
+	}
+
+	// Find the member containing the n-th newline, and the number of
+	// newlines to skip within it.
+	newlines := or.lines.Newlines
+	i := sort.Search(len(newlines), func(i int) bool {
+		return newlines[i] >= n
+	})
+	if i > 0 {
+		n -= newlines[i-1]
+	}
+	m := &or.lines.Index.Members[i]
+
+	// Decompress the member up to the newline, and give back to the
+	// reader the data read past it.
+	if err := or.SeekOffset(Offset{Block: m.Block}); err != nil {
+		return err
+	}
+	var off int64
+	buf := make([]byte, 32*1024)
+	for off < m.Size {
+		toread := m.Size - off
+		if toread > int64(len(buf)) {
+			toread = int64(len(buf))
+		}
+		nr, err := io.ReadFull(or, buf[:toread])
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errWrongOffset
+			}
+			return err
+		}
+		p := buf[:nr]
+		for j := bytes.IndexByte(p, '\n'); j >= 0; j = bytes.IndexByte(p, '\n') {
+			p = p[j+1:]
+			if n--; n == 0 {
+				or.unread(p)
+				return nil
+			}
+		}
+		off += int64(nr)
+	}
+	return errWrongOffset
+}
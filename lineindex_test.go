@@ -0,0 +1,111 @@
+package multigz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestSeekLine(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := loadDivina(t)
+	lines := bytes.SplitAfter(data, []byte{'\n'})
+
+	gz, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(n int) {
+		if err := gz.SeekLine(int64(n)); err != nil {
+			t.Fatalf("seek to line %d: %v", n, err)
+		}
+		buf := make([]byte, len(lines[n]))
+		if _, err := io.ReadFull(gz, buf); err != nil {
+			t.Fatalf("read line %d: %v", n, err)
+		}
+		if !bytes.Equal(buf, lines[n]) {
+			t.Errorf("invalid line %d: %q instead of %q", n, buf, lines[n])
+		}
+	}
+
+	// The first call builds the line index
+	check(1000)
+	if gz.lines.Lines() != int64(bytes.Count(data, []byte{'\n'})) {
+		t.Fatal("invalid number of lines:", gz.lines.Lines())
+	}
+	check(0)
+	check(len(lines) - 1)
+	for i := 0; i < 200; i++ {
+		check(rand.Intn(len(lines)))
+	}
+
+	// Lines beginning at member boundaries
+	for _, m := range gz.lines.Index.Members[1:] {
+		if data[m.Start-1] == '\n' {
+			check(bytes.Count(data[:m.Start], []byte{'\n'}))
+		}
+	}
+
+	if err := gz.SeekLine(int64(len(lines))); err == nil {
+		t.Error("seek past the last line did not fail")
+	}
+}
+
+func TestSeekLineSingleInflate(t *testing.T) {
+	data := loadDivina(t)
+	var buf bytes.Buffer
+	w, err := NewWriterLevel(&buf, -1, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	comp := buf.Bytes()
+
+	li, err := BuildLineIndex(bytes.NewReader(comp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if li.Lines() != int64(bytes.Count(data, []byte{'\n'})) {
+		t.Fatal("invalid number of lines:", li.Lines())
+	}
+
+	cr := &countReaderAt{r: bytes.NewReader(comp)}
+	gz, err := NewReader(io.NewSectionReader(cr, 0, int64(len(comp))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.SetLineIndex(li)
+
+	// The line beginning at the last newline of the second member: finding
+	// it requires decompressing the whole member, which must happen once.
+	m := li.Index.Members[1]
+	n := bytes.Count(data[:m.Start+m.Size-1], []byte{'\n'})
+	cr.n = 0
+	if err := gz.SeekLine(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	line := bytes.SplitAfter(data, []byte{'\n'})[n]
+	got := make([]byte, len(line))
+	if _, err := io.ReadFull(gz, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, line) {
+		t.Errorf("invalid line %d: %q instead of %q", n, got, line)
+	}
+	// Allow for the read-ahead buffers, but not for a second pass.
+	if cr.n > m.BlockSize*3/2 {
+		t.Errorf("read %d bytes for a member of %d bytes", cr.n, m.BlockSize)
+	}
+}
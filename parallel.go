@@ -0,0 +1,173 @@
+package multigz
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+var (
+	errReaderClosed = errors.New("read from a closed reader")
+)
+
+// A ParallelReader decompresses a multi-gzip using multiple goroutines.
+// Since each gzip member is independent, it reads ahead a few members and
+// decompresses them concurrently, while Read returns the decompressed data
+// in order. Create it with NewReaderParallel.
+type ParallelReader struct {
+	seq     *gzip.Reader
+	results chan chan memberResult
+	done    chan struct{}
+	wg      sync.WaitGroup
+	cur     []byte
+	err     error
+}
+
+type memberResult struct {
+	data []byte
+	err  error
+}
+
+// NewReaderParallel creates a ParallelReader that decompresses the multi-gzip
+// r using up to workers goroutines; if workers is zero or negative,
+// runtime.GOMAXPROCS is used.
+//
+// To find the members without decompressing them, the reader needs the
+// index of the file: it uses the embedded index, if present, or it builds
+// it from the size hints of the members. If neither is available (that is,
+// the file was not created by this package), the file is decompressed
+// sequentially, on a single goroutine.
+//
+// The whole file is read, irrespective of the current position of r.
+func NewReaderParallel(r io.ReadSeeker, workers int) (*ParallelReader, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	idx := loadEmbeddedIndex(r)
+	if idx == nil {
+		idx, _ = walkIndex(r)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	pr := &ParallelReader{
+		results: make(chan chan memberResult, workers),
+		done:    make(chan struct{}),
+	}
+	if idx == nil {
+		// No way to split the work: just decompress sequentially
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		pr.seq = gz
+		return pr, nil
+	}
+
+	pr.wg.Add(1)
+	go pr.dispatch(r, idx)
+	return pr, nil
+}
+
+// dispatch reads the compressed members in order, and starts a goroutine to
+// decompress each of them. The capacity of the results channel limits the
+// number of members being decompressed at the same time.
+func (pr *ParallelReader) dispatch(r io.Reader, idx *Index) {
+	defer pr.wg.Done()
+	defer close(pr.results)
+
+	var pos int64
+	for _, m := range idx.Members {
+		res := make(chan memberResult, 1)
+		select {
+		case pr.results <- res:
+		case <-pr.done:
+			return
+		}
+
+		// The index might be corrupted, so do not trust BlockSize for
+		// allocating the buffer: let it grow with the data actually read.
+		var cbuf bytes.Buffer
+		_, err := io.CopyN(ioutil.Discard, r, m.Block-pos)
+		if err == nil {
+			_, err = io.CopyN(&cbuf, r, m.BlockSize)
+		}
+		pos = m.Block + m.BlockSize
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			res <- memberResult{err: err}
+			return
+		}
+
+		cdata := cbuf.Bytes()
+		go func(size int64) {
+			data, err := inflateMember(cdata, size)
+			res <- memberResult{data: data, err: err}
+		}(m.Size)
+	}
+}
+
+// inflateMember decompresses the whole gzip member in cdata, verifying its
+// checksum. size is the expected decompressed length, used as a hint: it is
+// capped to what cdata can possibly expand to.
+func inflateMember(cdata []byte, size int64) ([]byte, error) {
+	if max := int64(len(cdata)) * maxDeflateRatio; size > max {
+		size = max
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(cdata))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	gz.Multistream(false)
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(buf, gz); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Read reads decompressed data from the multi-gzip, in order.
+func (pr *ParallelReader) Read(data []byte) (int, error) {
+	if pr.seq != nil && pr.err == nil {
+		return pr.seq.Read(data)
+	}
+	for len(pr.cur) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		res, ok := <-pr.results
+		if !ok {
+			pr.err = io.EOF
+			continue
+		}
+		r := <-res
+		pr.cur, pr.err = r.data, r.err
+	}
+
+	n := copy(data, pr.cur)
+	pr.cur = pr.cur[n:]
+	return n, nil
+}
+
+// Close stops the decompression; it does not close the underlying reader,
+// but once Close returns, the ParallelReader does not access it anymore.
+func (pr *ParallelReader) Close() error {
+	if pr.err != errReaderClosed {
+		close(pr.done)
+		pr.wg.Wait()
+		pr.err = errReaderClosed
+		pr.cur = nil
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package multigz
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParallelReader(t *testing.T) {
+	data := loadDivina(t)
+
+	var embedded, hinted bytes.Buffer
+	for _, buf := range []*bytes.Buffer{&embedded, &hinted} {
+		w, err := NewWriterLevelOptions(buf, -1, 4096,
+			&WriterOptions{EmbedIndex: buf == &embedded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain, err := ioutil.ReadFile("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range [][]byte{embedded.Bytes(), hinted.Bytes(), plain} {
+		for _, workers := range []int{0, 1, 3} {
+			pr, err := NewReaderParallel(bytes.NewReader(file), workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Error("invalid decompressed data with workers:", workers)
+			}
+			pr.Close()
+		}
+	}
+
+	// Closing before reading everything must not leak or hang, and the
+	// underlying reader must be usable again after Close.
+	r := bytes.NewReader(hinted.Bytes())
+	pr, err := NewReaderParallel(r, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.Read(make([]byte, 10))
+	pr.Close()
+	if _, err := pr.Read(make([]byte, 10)); err == nil {
+		t.Error("read after close did not fail")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,13 +10,14 @@ import (
 )
 
 var (
-	errWrongOffset = errors.New("the offset does not appear to match the gzip layout")
+	errWrongOffset   = errors.New("the offset does not appear to match the gzip layout")
+	errInvalidWhence = errors.New("invalid whence value")
 )
 
 // Offset represents a specific point in the decompressed stream where we want
 // to seek at. The normal way to obtain an Offset is to call Reader.Offset() of
 // Writer.Offset() at the specific point in the stream we are interested into;
-// later, it is possible to call Reder.Seek() passing the Offset to efficiently
+// later, it is possible to call Reader.SeekOffset() passing the Offset to efficiently
 // get back to that point.
 type Offset struct {
 	Block int64
@@ -35,8 +36,11 @@ func (cw *countReader) Read(data []byte) (n int, err error) {
 }
 
 func (cw *countReader) ReadByte() (ch byte, err error) {
-	(*cw.Cnt) += 1
-	return cw.R.ReadByte()
+	ch, err = cw.R.ReadByte()
+	if err == nil {
+		(*cw.Cnt) += 1
+	}
+	return
 }
 
 // A multigz.Reader is 100% equivalent to a gzip.Reader, but allows to seek
@@ -44,17 +48,39 @@ func (cw *countReader) ReadByte() (ch byte, err error) {
 //
 // The idea is to use a multi-pass approach; in the first pass, you can go
 // through the file and record the positions of interest by calling Offset().
-// Then, you can seek to a specific offset by calling Seek().
+// Then, you can seek to a specific offset by calling SeekOffset().
+//
+// Reader also implements io.Seeker over positions in the decompressed
+// stream; this requires an Index of the file, which is built on first use
+// unless one is provided with SetIndex() or embedded in the file.
 type Reader struct {
 	gz    *gzip.Reader
 	ur    io.Reader
 	r     io.ReadSeeker
+	idx   *Index
+	lines *LineIndex
 	cnt   int64
 	noff  int64
 	block int64
 	delim bool
+
+	// With a cache, SeekOffset reads the whole target member in memory:
+	// mem holds its data that has not been read yet, and next is the
+	// offset of the following member.
+	cache   *BlockCache
+	cacheID string
+	inMem   bool
+	mem     []byte
+	next    int64
+
+	// pending holds data that was read past the current position, and
+	// given back with unread: it is returned before anything else.
+	pending []byte
 }
 
+// NewReader creates a new Reader reading the multi-gzip r. If r contains an
+// embedded index (see WriterOptions.EmbedIndex), it is loaded by the first
+// call to Seek.
 func NewReader(r io.ReadSeeker) (*Reader, error) {
 	or := new(Reader)
 	or.r = r
@@ -76,12 +102,46 @@ func (or *Reader) createUnderlyingReader() io.Reader {
 }
 
 func (or *Reader) Read(data []byte) (int, error) {
+	nread := 0
+	if len(or.pending) > 0 {
+		n := copy(data, or.pending)
+		or.pending = or.pending[n:]
+		or.noff += int64(n)
+		nread += n
+		data = data[n:]
+		if len(data) == 0 {
+			return nread, nil
+		}
+	}
+	if or.inMem {
+		n := copy(data, or.mem)
+		or.mem = or.mem[n:]
+		or.noff += int64(n)
+		nread += n
+		data = data[n:]
+		if len(data) == 0 {
+			return nread, nil
+		}
+		// The member is over: continue decompressing from the next one
+		if err := or.restart(or.next); err != nil {
+			if err == io.EOF {
+				return nread, nil
+			}
+			return nread, err
+		}
+		or.delim = true
+	}
 	if or.gz == nil {
+		if nread > 0 {
+			return nread, nil
+		}
 		return 0, io.EOF
 	}
-	nread := 0
 	for len(data) > 0 {
 		n, err := or.gz.Read(data)
+		or.noff += int64(n)
+		nread += n
+		data = data[n:]
 		if err == io.EOF {
 			or.noff = 0
 			or.block = or.cnt
@@ -95,16 +155,24 @@ func (or *Reader) Read(data []byte) (int, error) {
 			continue
 		}
 		if err != nil {
-			return nread + n, err
+			return nread, err
 		}
-		or.noff += int64(n)
-		nread += n
-		data = data[n:]
 	}
 	return nread, nil
 }
 
+// unread gives back data to the reader, moving the current position
+// backwards: data must be the last bytes returned by Read, within the
+// current member.
+func (or *Reader) unread(data []byte) {
+	or.pending = data
+	or.noff -= int64(len(data))
+}
+
 func (or *Reader) Close() error {
+	or.inMem = false
+	or.mem = nil
+	or.pending = nil
 	if or.gz == nil {
 		return nil
 	}
@@ -117,9 +185,12 @@ func (or *Reader) Offset() Offset {
 	return Offset{Block: or.block, Off: or.noff}
 }
 
-func (or *Reader) Seek(o Offset) error {
+// SeekOffset moves the reader to the specified Offset, that must have been
+// previously obtained by calling Offset() on a Reader or Writer for the
+// same file.
+func (or *Reader) SeekOffset(o Offset) error {
 	cur := or.Offset()
-	if cur.Block == o.Block && cur.Off < o.Off {
+	if cur.Block == o.Block && cur.Off <= o.Off {
 		_, err := io.CopyN(ioutil.Discard, or, o.Off-cur.Off)
 		if err != nil {
 			return err
@@ -127,8 +198,35 @@ func (or *Reader) Seek(o Offset) error {
 		return nil
 	}
 
-	or.r.Seek(o.Block, 0)
-	or.cnt = o.Block
+	if or.cache != nil {
+		if ok, err := or.seekCached(o); ok || err != nil {
+			return err
+		}
+	}
+
+	if err := or.restart(o.Block); err != nil {
+		if err == io.EOF {
+			err = errWrongOffset
+		}
+		return err
+	}
+
+	_, err := io.CopyN(ioutil.Discard, or, o.Off)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// restart starts decompressing the member at offset block of the
+// compressed file. It returns io.EOF if there is no member there.
+func (or *Reader) restart(block int64) error {
+	or.inMem = false
+	or.mem = nil
+	or.pending = nil
+	or.r.Seek(block, io.SeekStart)
+	or.cnt = block
 
 	if or.gz == nil {
 		gz, err := gzip.NewReader(or.createUnderlyingReader())
@@ -140,20 +238,146 @@ func (or *Reader) Seek(o Offset) error {
 		or.gz.Close()
 		if or.gz.Reset(or.createUnderlyingReader()) == io.EOF {
 			or.gz = nil
-			return errWrongOffset
+			return io.EOF
 		}
 	}
 
 	or.gz.Multistream(false)
-	or.block = o.Block
+	or.block = block
 	or.noff = 0
+	return nil
+}
 
-	_, err := io.CopyN(ioutil.Discard, or, o.Off)
-	if err != nil {
-		return err
+// SetCache makes the Reader keep the members it seeks into in c, so that
+// seeking again into one of them does not require decompressing it. With a
+// cache, SeekOffset reads the whole member it seeks into, unless it is
+// bigger than the cache itself.
+//
+// id identifies the content of the underlying file within c, as in
+// ReaderAt.SetCache.
+func (or *Reader) SetCache(c *BlockCache, id string) {
+	or.cache = c
+	or.cacheID = id
+}
+
+// seekCached moves the reader to the Offset o, serving the data of the
+// member from the cache, or loading it into the cache. It returns false if
+// the member cannot be cached, and the seek must be done normally.
+func (or *Reader) seekCached(o Offset) (bool, error) {
+	data, blockSize, ok := or.cache.get(or.cacheID, o.Block)
+	if !ok {
+		// Members bigger than the cache are read normally; with an
+		// index, there is no need to decompress them to find out.
+		if or.idx != nil {
+			if m := or.idx.member(o.Block); m != nil && m.Size > or.cache.max {
+				return false, nil
+			}
+		}
+		if _, err := or.r.Seek(o.Block, io.SeekStart); err != nil {
+			return false, err
+		}
+		var cnt int64
+		gz, err := gzip.NewReader(&countReader{R: bufio.NewReader(or.r), Cnt: &cnt})
+		if err != nil {
+			if err == io.EOF {
+				err = errWrongOffset
+			}
+			return false, err
+		}
+		defer gz.Close()
+		gz.Multistream(false)
+
+		// Members bigger than the cache are read normally
+		data, err = ioutil.ReadAll(io.LimitReader(gz, or.cache.max+1))
+		if err != nil {
+			return false, err
+		}
+		if int64(len(data)) > or.cache.max {
+			return false, nil
+		}
+		// Reach the end of the member, to read the trailer and find its
+		// compressed size.
+		if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+			return false, err
+		}
+		blockSize = cnt
+		or.cache.add(or.cacheID, o.Block, blockSize, data)
 	}
 
-	return nil
+	if o.Off > int64(len(data)) {
+		return false, errWrongOffset
+	}
+	or.inMem = true
+	or.mem = data[o.Off:]
+	or.pending = nil
+	or.next = o.Block + blockSize
+	or.block = o.Block
+	or.noff = o.Off
+	return true, nil
+}
+
+// SetIndex sets the Index used by Seek to translate positions in the
+// decompressed stream into Offsets. It is not required to call it, but it
+// avoids scanning the whole file at the first call to Seek.
+func (or *Reader) SetIndex(idx *Index) {
+	or.idx = idx
+}
+
+// Index returns the Index used by Seek, or nil if it was neither set with
+// SetIndex nor built by a previous call to Seek.
+func (or *Reader) Index() *Index {
+	return or.idx
+}
+
+// Seek implements io.Seeker over the decompressed stream: offset is
+// interpreted as a position in the decompressed data, according to whence
+// (io.SeekStart, io.SeekCurrent or io.SeekEnd). Seeking beyond the end of
+// the stream is not supported.
+//
+// If no Index was provided with SetIndex, the first call to Seek loads the
+// index embedded in the file, if any, or builds one by scanning the whole
+// file.
+func (or *Reader) Seek(offset int64, whence int) (int64, error) {
+	cur := or.Offset()
+	if or.idx == nil {
+		idx, err := ReadEmbeddedIndex(or.r)
+		if err != nil {
+			idx, err = BuildIndex(or.r)
+		}
+		if err != nil {
+			return 0, err
+		}
+		or.idx = idx
+		// Reading the index moved the underlying reader, so the current
+		// position cannot be trusted anymore: make sure SeekOffset
+		// restarts decompression from scratch.
+		or.block = -1
+	}
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		cpos, err := or.idx.Pos(cur)
+		if err != nil {
+			return 0, err
+		}
+		pos = cpos + offset
+	case io.SeekEnd:
+		pos = or.idx.Size() + offset
+	default:
+		return 0, errInvalidWhence
+	}
+
+	o, err := or.idx.Offset(pos)
+	if err != nil {
+		return 0, err
+	}
+	if err := or.SeekOffset(o); err != nil {
+		return 0, err
+	}
+	return pos, nil
 }
 
 // Return true if we found at least a multi-gzip separtor while reading this
@@ -30,6 +30,25 @@ func calcHash(r io.ReadSeeker, multigz bool, t *testing.T) string {
 	return hex.EncodeToString(sum)
 }
 
+// loadDivina returns the decompressed content of testdata/divina.txt.gz,
+// which most tests use as sample data.
+func loadDivina(t testing.TB) []byte {
+	f, err := os.Open("testdata/divina.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
 func TestBasicReader(t *testing.T) {
 	for idx, fn := range []string{"testdata/divina.txt.gz", "testdata/divina2.txt.gz"} {
 		f, err := os.Open(fn)
@@ -88,7 +107,7 @@ func TestIndex(t *testing.T) {
 	perm := rand.Perm(len(pos))
 	for _, idx := range perm {
 		p := pos[idx]
-		gz.Seek(p.Off)
+		gz.SeekOffset(p.Off)
 		hash := sha1.New()
 		io.CopyN(hash, gz, 64)
 		sum := hash.Sum([]byte{})
@@ -106,3 +125,60 @@ func TestIndexMassive(t *testing.T) {
 		TestIndex(t)
 	}
 }
+
+func TestSeeker(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure Reader can be used wherever an io.ReadSeeker is expected
+	var rs io.ReadSeeker = gz
+
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != int64(len(data)) {
+		t.Fatal("invalid stream size:", end, len(data))
+	}
+
+	seed := time.Now().UnixNano()
+	t.Log("using seed:", seed)
+	rand.Seed(seed)
+	for i := 0; i < 200; i++ {
+		pos := rand.Int63n(int64(len(data)) - 64)
+		if i%2 == 0 {
+			cur, _ := rs.Seek(0, io.SeekCurrent)
+			if n, err := rs.Seek(pos-cur, io.SeekCurrent); err != nil || n != pos {
+				t.Fatal("invalid relative seek:", n, pos, err)
+			}
+		} else {
+			if n, err := rs.Seek(pos, io.SeekStart); err != nil || n != pos {
+				t.Fatal("invalid absolute seek:", n, pos, err)
+			}
+		}
+
+		buf := make([]byte, 64)
+		if _, err := io.ReadFull(rs, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(data[pos:pos+64]) {
+			t.Errorf("invalid data at position %d", pos)
+		}
+	}
+
+	if _, err := rs.Seek(1, io.SeekEnd); err == nil {
+		t.Error("seeking past the end did not fail")
+	}
+}
@@ -0,0 +1,295 @@
+package multigz
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// Maximum amount of compressed data that ReaderAt reads from the underlying
+// file with a single call. Adjacent members are read together up to this
+// size, to reduce the number of calls for large reads. Bigger members are
+// streamed from the underlying file, in chunks of streamBufferSize bytes.
+const (
+	maxCoalesceSize  = 4 * 1024 * 1024
+	streamBufferSize = 256 * 1024
+)
+
+// Maximum number of resume points kept by a ReaderAt.
+const maxResumePoints = 8
+
+// Maximum number of first records of members cached by a ReaderAt for
+// Search.
+const maxFirstRecords = 4096
+
+// A ReaderAt gives random access to the decompressed stream of a multi-gzip,
+// implementing io.ReaderAt.
+//
+// Each call to ReadAt decompresses only the members that overlap with the
+// requested range. When a read ends within a member, the decompressor is
+// kept aside, so that a following read that continues from there (like
+// reading the stream sequentially through io.SectionReader) does not need
+// to decompress the member from its beginning again. Up to 8 decompressors
+// are kept aside, each one holding its own state and up to 4 MB of
+// compressed data read from the underlying file: so, a ReaderAt can keep
+// about 32 MB of memory in use after the reads are done.
+//
+// The decompressors kept aside are protected by a lock, so it is safe to
+// call ReadAt from multiple goroutines at the same time, provided that the
+// underlying io.ReaderAt also is (like *os.File).
+type ReaderAt struct {
+	r       io.ReaderAt
+	idx     *Index
+	cache   *BlockCache
+	cacheID string
+
+	mu     sync.Mutex
+	resume []*resumePoint
+
+	// firsts caches the first record of the members probed by Search,
+	// keyed by their Block. It is emptied when it gets too big.
+	firsts map[int64][]byte
+}
+
+// A resumePoint is a decompressor suspended at position pos within the
+// member at offset block.
+type resumePoint struct {
+	block int64
+	pos   int64
+	gz    *gzip.Reader
+}
+
+// NewReaderAt creates a ReaderAt over r, using idx to locate the members.
+// If idx is nil, the whole file is scanned to build it (see BuildIndex);
+// use ReadEmbeddedIndex to load the index embedded in the file, if any.
+func NewReaderAt(r io.ReaderAt, idx *Index) (*ReaderAt, error) {
+	if idx == nil {
+		var err error
+		idx, err = BuildIndex(io.NewSectionReader(r, 0, math.MaxInt64))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ReaderAt{r: r, idx: idx}, nil
+}
+
+// Size returns the length of the decompressed stream.
+func (ra *ReaderAt) Size() int64 {
+	return ra.idx.Size()
+}
+
+// Index returns the Index used by the ReaderAt.
+func (ra *ReaderAt) Index() *Index {
+	return ra.idx
+}
+
+// SetCache makes the ReaderAt keep the members it decompresses in c, and
+// look them up there before decompressing them again. Members bigger than
+// c are streamed, as without a cache. It must be called before using the
+// ReaderAt.
+//
+// id identifies the content of the underlying file within c: readers with
+// the same id share the cached members, so id must change whenever the file
+// does (for instance, it can include the modification time and size of the
+// file, besides its name).
+func (ra *ReaderAt) SetCache(c *BlockCache, id string) {
+	ra.cache = c
+	ra.cacheID = id
+}
+
+// ReadAt reads len(p) bytes of the decompressed stream, starting at position
+// off. It follows the io.ReaderAt semantics, so it returns io.EOF if fewer
+// than len(p) bytes are available.
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errSeekOutOfRange
+	}
+	size := ra.idx.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > size {
+		end = size
+	}
+
+	n := 0
+	members := ra.idx.Members[ra.idx.find(off):]
+	for off+int64(n) < end && len(members) > 0 {
+		m := &members[0]
+		pos := off + int64(n)
+		if ra.cacheable(m) {
+			if data, _, ok := ra.cache.get(ra.cacheID, m.Block); ok {
+				n += copy(p[n:end-off], data[pos-m.Start:])
+				members = members[1:]
+				continue
+			}
+		} else if m.BlockSize > maxCoalesceSize || ra.canResume(m.Block, pos-m.Start) {
+			// Stream the member from the underlying file, or from
+			// where the previous read stopped.
+			mend := m.Start + m.Size
+			if mend > end {
+				mend = end
+			}
+			nn, err := ra.readMember(p[n:n+int(mend-pos)], m, nil, pos-m.Start)
+			n += nn
+			if err != nil {
+				return n, err
+			}
+			members = members[1:]
+			continue
+		}
+
+		// Group adjacent members, so that they can be read from the
+		// underlying file with a single call.
+		cnt := 1
+		for cnt < len(members) && members[cnt].Start < end &&
+			members[cnt].Block+members[cnt].BlockSize-members[0].Block <= maxCoalesceSize &&
+			(ra.cache == nil || !ra.cache.contains(ra.cacheID, members[cnt].Block)) {
+			cnt++
+		}
+		group := members[:cnt]
+		members = members[cnt:]
+
+		base := group[0].Block
+		last := group[len(group)-1]
+		buf := make([]byte, last.Block+last.BlockSize-base)
+		if _, err := ra.r.ReadAt(buf, base); err != nil && err != io.EOF {
+			return n, err
+		}
+
+		for _, m := range group {
+			if m.Size == 0 {
+				continue
+			}
+			pos := off + int64(n)
+			mend := m.Start + m.Size
+			if mend > end {
+				mend = end
+			}
+			cdata := buf[m.Block-base : m.Block-base+m.BlockSize]
+			if ra.cacheable(&m) {
+				// Decompress the whole member, to cache it
+				data, err := inflateMember(cdata, m.Size)
+				if err != nil {
+					return n, err
+				}
+				if int64(len(data)) != m.Size {
+					return n, errWrongOffset
+				}
+				ra.cache.add(ra.cacheID, m.Block, m.BlockSize, data)
+				n += copy(p[n:n+int(mend-pos)], data[pos-m.Start:])
+				continue
+			}
+			nn, err := ra.readMember(p[n:n+int(mend-pos)], &m, cdata, pos-m.Start)
+			n += nn
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// cacheable reports whether member m is kept in the cache. Members bigger
+// than the cache, or than maxCoalesceSize once compressed, are streamed
+// instead, so that they are never held in memory as a whole.
+func (ra *ReaderAt) cacheable(m *Member) bool {
+	return ra.cache != nil && m.Size <= ra.cache.max && m.BlockSize <= maxCoalesceSize
+}
+
+// readMember decompresses member m, and copies into p the decompressed bytes
+// starting at position skip within the member. The compressed member is
+// cdata if not nil, otherwise it is streamed from the underlying file. It
+// resumes from a previous read, if possible, and if p ends before the end of
+// the member, it saves the decompressor for a following read.
+func (ra *ReaderAt) readMember(p []byte, m *Member, cdata []byte, skip int64) (int, error) {
+	rp := ra.takeResume(m.Block, skip)
+	if rp == nil {
+		var src io.Reader
+		if cdata != nil {
+			src = bytes.NewReader(cdata)
+		} else {
+			src = bufio.NewReaderSize(io.NewSectionReader(ra.r, m.Block, m.BlockSize), streamBufferSize)
+		}
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return 0, err
+		}
+		gz.Multistream(false)
+		rp = &resumePoint{block: m.Block, gz: gz}
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, rp.gz, skip-rp.pos); err != nil {
+		rp.gz.Close()
+		if err == io.EOF {
+			err = errWrongOffset
+		}
+		return 0, err
+	}
+	n, err := io.ReadFull(rp.gz, p)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = errWrongOffset
+	}
+	rp.pos = skip + int64(n)
+	if err == nil && rp.pos < m.Size {
+		ra.saveResume(rp)
+	} else {
+		rp.gz.Close()
+	}
+	return n, err
+}
+
+// canResume reports whether there is a resume point within the member at
+// offset block, before or at position pos.
+func (ra *ReaderAt) canResume(block int64, pos int64) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for _, rp := range ra.resume {
+		if rp.block == block && rp.pos <= pos {
+			return true
+		}
+	}
+	return false
+}
+
+// takeResume removes and returns the resume point within the member at
+// offset block that is closest to position pos (without going past it), or
+// nil if there is none.
+func (ra *ReaderAt) takeResume(block int64, pos int64) *resumePoint {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	best := -1
+	for i, rp := range ra.resume {
+		if rp.block == block && rp.pos <= pos && (best < 0 || rp.pos > ra.resume[best].pos) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	rp := ra.resume[best]
+	ra.resume = append(ra.resume[:best], ra.resume[best+1:]...)
+	return rp
+}
+
+// saveResume stores a resume point, discarding the oldest one if there are
+// too many.
+func (ra *ReaderAt) saveResume(rp *resumePoint) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if len(ra.resume) == maxResumePoints {
+		ra.resume[0].gz.Close()
+		ra.resume = ra.resume[1:]
+	}
+	ra.resume = append(ra.resume, rp)
+}
@@ -0,0 +1,123 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReaderAt(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := loadDivina(t)
+
+	ra, err := NewReaderAt(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.Size() != int64(len(data)) {
+		t.Fatal("invalid size:", ra.Size(), len(data))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 50; i++ {
+				off := rnd.Int63n(int64(len(data)))
+				buf := make([]byte, rnd.Intn(200000)+1)
+				n, err := ra.ReadAt(buf, off)
+				want := data[off:]
+				if len(want) > len(buf) {
+					want = want[:len(buf)]
+				}
+				if n != len(want) {
+					t.Errorf("short read at %d: %d instead of %d", off, n, len(want))
+					return
+				}
+				if n < len(buf) && err != io.EOF {
+					t.Errorf("missing EOF at %d: %v", off, err)
+				}
+				if n == len(buf) && err != nil {
+					t.Errorf("error at %d: %v", off, err)
+				}
+				if string(buf[:n]) != string(want) {
+					t.Errorf("invalid data at %d", off)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	if n, err := ra.ReadAt(make([]byte, 10), ra.Size()); n != 0 || err != io.EOF {
+		t.Error("read past the end did not return EOF:", n, err)
+	}
+}
+
+// countReaderAt counts the bytes read from an io.ReaderAt.
+type countReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (cr *countReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cr.r.ReadAt(p, off)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func TestReaderAtSequential(t *testing.T) {
+	divina, err := ioutil.ReadFile("testdata/divina.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := loadDivina(t)
+
+	// A member bigger than maxCoalesceSize, which is streamed
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, maxCoalesceSize+1024*1024)
+	rnd.Read(big)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading a single member in small sequential chunks must
+	// decompress it only once.
+	for _, file := range []struct{ comp, data []byte }{{divina, data}, {buf.Bytes(), big}} {
+		cr := &countReaderAt{r: bytes.NewReader(file.comp)}
+		idx, err := BuildIndex(bytes.NewReader(file.comp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ra, err := NewReaderAt(cr, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, file.data) {
+			t.Error("invalid data")
+		}
+		if cr.n > int64(len(file.comp))+streamBufferSize {
+			t.Errorf("read %d bytes of a %d bytes file", cr.n, len(file.comp))
+		}
+	}
+}
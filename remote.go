@@ -0,0 +1,180 @@
+package multigz
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errNoContentLength = errors.New("remote server did not report the file size")
+)
+
+// remoteScanSize is the size of the ranges fetched when the whole remote
+// file must be scanned to build its index.
+const remoteScanSize = 4 * 1024 * 1024
+
+// A RangeFetcher gives access to byte ranges of a remote file, for instance
+// through HTTP Range requests. Each call to FetchRange is expected to cost a
+// network round-trip, so NewRemoteReader issues as few of them as possible.
+type RangeFetcher interface {
+	// FetchRange reads len(p) bytes of the remote file, starting at
+	// offset off. The range is always within the file.
+	FetchRange(p []byte, off int64) error
+
+	// Size returns the length of the remote file.
+	Size() (int64, error)
+}
+
+// HTTPFetcher is a RangeFetcher that reads a file from a HTTP server that
+// supports Range requests (like most object stores). The size of the file
+// is taken from the Content-Range header of a request for its first byte,
+// and it is requested only once (unless the request fails).
+type HTTPFetcher struct {
+	URL string
+
+	// Client is the HTTP client used for the requests; if nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	mu    sync.Mutex
+	size  int64
+	known bool
+}
+
+func (hf *HTTPFetcher) client() *http.Client {
+	if hf.Client != nil {
+		return hf.Client
+	}
+	return http.DefaultClient
+}
+
+// Size returns the length of the remote file, as reported by the server.
+func (hf *HTTPFetcher) Size() (int64, error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	if hf.known {
+		return hf.size, nil
+	}
+
+	req, err := http.NewRequest("GET", hf.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := hf.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// The length follows the range (or "*", for empty files)
+		cr := resp.Header.Get("Content-Range")
+		i := strings.LastIndexByte(cr, '/')
+		if !strings.HasPrefix(cr, "bytes ") || i < 0 {
+			return 0, errNoContentLength
+		}
+		if size, err = strconv.ParseInt(cr[i+1:], 10, 64); err != nil || size < 0 {
+			return 0, errNoContentLength
+		}
+	case http.StatusOK:
+		// The Range header was ignored, and the whole file is sent
+		if resp.ContentLength < 0 {
+			return 0, errNoContentLength
+		}
+		size = resp.ContentLength
+	default:
+		return 0, fmt.Errorf("multigz: GET %s: %s", hf.URL, resp.Status)
+	}
+	hf.size = size
+	hf.known = true
+	return size, nil
+}
+
+// FetchRange reads len(p) bytes of the remote file starting at off, with a
+// single Range request. It fails unless the server replies with exactly the
+// requested range.
+func (hf *HTTPFetcher) FetchRange(p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest("GET", hf.URL, nil)
+	if err != nil {
+		return err
+	}
+	rng := strconv.FormatInt(off, 10) + "-" + strconv.FormatInt(off+int64(len(p))-1, 10)
+	req.Header.Set("Range", "bytes="+rng)
+	resp, err := hf.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("multigz: GET %s: %s", hf.URL, resp.Status)
+	}
+	if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, "bytes "+rng+"/") {
+		return fmt.Errorf("multigz: GET %s: unexpected Content-Range %q for bytes %s", hf.URL, cr, rng)
+	}
+	_, err = io.ReadFull(resp.Body, p)
+	return err
+}
+
+// fetcherReaderAt adapts a RangeFetcher to io.ReaderAt.
+type fetcherReaderAt struct {
+	f    RangeFetcher
+	size int64
+}
+
+func (fr *fetcherReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= fr.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if int64(n) > fr.size-off {
+		n = int(fr.size - off)
+	}
+	if err := fr.f.FetchRange(p[:n], off); err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// NewRemoteReader creates a ReaderAt over a remote multi-gzip accessed
+// through f. Each ReadAt fetches only the members that overlap with the
+// requested range, coalescing adjacent members into a single request (see
+// ReaderAt); use Index.Pos to read from a given Offset.
+//
+// If idx is nil, the embedded index of the file is used, if present (which
+// costs a few requests). Otherwise, the whole file is downloaded, in ranges
+// of a few megabytes, and decompressed to build the index: for files
+// without an embedded index, it is much cheaper to provide the index, for
+// instance by reading the .gzi file written next to the multi-gzip.
+func NewRemoteReader(f RangeFetcher, idx *Index) (*ReaderAt, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	ra := &fetcherReaderAt{f: f, size: size}
+	if idx == nil {
+		sr := io.NewSectionReader(ra, 0, size)
+		if idx, err = ReadEmbeddedIndex(sr); err != nil {
+			seq := bufio.NewReaderSize(io.NewSectionReader(ra, 0, size), remoteScanSize)
+			if idx, err = scanMembers(seq, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return NewReaderAt(ra, idx)
+}
@@ -0,0 +1,137 @@
+package multigz
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteReader(t *testing.T) {
+	data := loadDivina(t)
+
+	for _, embed := range []bool{false, true} {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelOptions(&buf, -1, 8192, &WriterOptions{EmbedIndex: embed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		comp := buf.Bytes()
+
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.ServeContent(w, r, "file.gz", time.Time{}, bytes.NewReader(comp))
+		}))
+		defer srv.Close()
+
+		ra, err := NewRemoteReader(&HTTPFetcher{URL: srv.URL}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ra.Size() != int64(len(data)) {
+			t.Fatal("invalid size:", ra.Size())
+		}
+		if embed && requests > 8 {
+			t.Error("too many requests to load the embedded index:", requests)
+		}
+		// Without the embedded index, the file is scanned in large
+		// ranges: the size, the probe for the embedded index, and a single
+		// range for the whole (small) file.
+		if !embed && requests > 3 {
+			t.Error("too many requests to build the index:", requests)
+		}
+
+		for i := 0; i < 20; i++ {
+			off := rand.Int63n(int64(len(data)))
+			p := make([]byte, rand.Intn(100000)+1)
+			atomic.StoreInt32(&requests, 0)
+			n, err := ra.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p[:n], data[off:off+int64(n)]) || (n < len(p) && off+int64(n) != int64(len(data))) {
+				t.Errorf("invalid data at %d", off)
+			}
+			// The range covers less than maxCoalesceSize of compressed
+			// data, so it must be fetched with a single request (or none,
+			// if it follows a previous read within the same member).
+			if requests > 1 {
+				t.Errorf("read at %d required %d requests", off, requests)
+			}
+		}
+	}
+}
+
+func TestHTTPFetcherRange(t *testing.T) {
+	data := []byte("0123456789")
+	for _, handler := range []http.HandlerFunc{
+		// Range header ignored
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		},
+		// Different range returned
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 2-5/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[2:6])
+		},
+	} {
+		srv := httptest.NewServer(handler)
+		hf := &HTTPFetcher{URL: srv.URL}
+		if err := hf.FetchRange(make([]byte, 4), 0); err == nil {
+			t.Error("invalid range response accepted")
+		}
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	p := make([]byte, 4)
+	if err := (&HTTPFetcher{URL: srv.URL}).FetchRange(p, 3); err != nil || string(p) != "3456" {
+		t.Errorf("invalid range: %q %v", p, err)
+	}
+}
+
+func TestHTTPFetcherSize(t *testing.T) {
+	data := []byte("0123456789")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HEAD is not supported, and the first request fails
+		if r.Method != "GET" {
+			http.Error(w, "HEAD not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	hf := &HTTPFetcher{URL: srv.URL}
+	if _, err := hf.Size(); err == nil {
+		t.Error("failed request accepted")
+	}
+	for i := 0; i < 2; i++ {
+		if size, err := hf.Size(); err != nil || size != int64(len(data)) {
+			t.Errorf("invalid size: %d %v", size, err)
+		}
+	}
+	if requests != 2 {
+		t.Error("the size was not cached:", requests)
+	}
+}
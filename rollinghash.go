@@ -0,0 +1,154 @@
+package multigz
+
+import "math/bits"
+
+// RollingHash selects the rolling hash function used by the rsyncable writer
+// to find the points where the stream is segmented. The segmenting points
+// depend only on the last bytes of the stream (the window), so they resync
+// after a localized change in the data.
+type RollingHash int
+
+const (
+	// HashSum is the sum of the bytes in the window, as used by
+	// "gzip --rsyncable". This is the default.
+	HashSum RollingHash = iota
+
+	// HashBuzhash is a cyclic polynomial hash, which distributes
+	// boundaries much better than HashSum on low-entropy data.
+	HashBuzhash
+
+	// HashGear is the hash used by FastCDC; it is the fastest to compute,
+	// and its window is always 64 bytes, irrespective of WindowSize.
+	HashGear
+)
+
+// roller is the interface implemented by the rolling hashes.
+type roller interface {
+	// reset clears the window, at the beginning of a new block.
+	reset()
+
+	// roll adds a byte to the window, dropping the oldest one if the
+	// window is full.
+	roll(b byte)
+
+	// split reports whether the block must be split after the last byte
+	// added to the window.
+	split() bool
+}
+
+func newRoller(h RollingHash, window int, avg int) roller {
+	switch h {
+	case HashBuzhash:
+		return &buzhashRoller{window: make([]byte, window), avg: uint32(avg)}
+	case HashGear:
+		return &gearRoller{mask: gearMask(avg)}
+	default:
+		return &sumRoller{window: make([]byte, window), avg: avg}
+	}
+}
+
+type sumRoller struct {
+	window []byte
+	n      int
+	sum    int
+	avg    int
+}
+
+func (r *sumRoller) reset() {
+	r.n = 0
+	r.sum = 0
+}
+
+func (r *sumRoller) roll(b byte) {
+	i := r.n % len(r.window)
+	if r.n >= len(r.window) {
+		r.sum -= int(r.window[i])
+	}
+	r.window[i] = b
+	r.sum += int(b)
+	r.n++
+}
+
+func (r *sumRoller) split() bool {
+	// Like gzip, only split once the window has been filled
+	return r.n > len(r.window) && r.sum%r.avg == 0
+}
+
+type buzhashRoller struct {
+	window []byte
+	n      int
+	h      uint32
+	avg    uint32
+}
+
+func (r *buzhashRoller) reset() {
+	r.n = 0
+	r.h = 0
+}
+
+func (r *buzhashRoller) roll(b byte) {
+	i := r.n % len(r.window)
+	r.h = bits.RotateLeft32(r.h, 1) ^ buzhashTable[b]
+	if r.n >= len(r.window) {
+		r.h ^= bits.RotateLeft32(buzhashTable[r.window[i]], len(r.window))
+	}
+	r.window[i] = b
+	r.n++
+}
+
+func (r *buzhashRoller) split() bool {
+	return r.n >= len(r.window) && r.h%r.avg == 0
+}
+
+type gearRoller struct {
+	h    uint64
+	mask uint64
+}
+
+func (r *gearRoller) reset() {
+	r.h = 0
+}
+
+func (r *gearRoller) roll(b byte) {
+	r.h = (r.h << 1) + gearTable[b]
+}
+
+func (r *gearRoller) split() bool {
+	return r.h&r.mask == 0
+}
+
+// gearMask returns a mask selecting the most significant bits of the gear
+// hash, so that a boundary is found on average every avg bytes. The most
+// significant bits are used because they depend on the most bytes.
+func gearMask(avg int) uint64 {
+	n := bits.Len(uint(avg)) - 1
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// Random tables for buzhash and gear. They are generated with a fixed seed,
+// as the output of the writers must not change across runs.
+var (
+	buzhashTable [256]uint32
+	gearTable    [256]uint64
+)
+
+func init() {
+	// splitmix64
+	seed := uint64(0x6d756c7469677a)
+	next := func() uint64 {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		return z ^ (z >> 31)
+	}
+	for i := range buzhashTable {
+		buzhashTable[i] = uint32(next())
+	}
+	for i := range gearTable {
+		gearTable[i] = next()
+	}
+}
@@ -1,6 +1,7 @@
 package multigz
 
 import (
+	"bytes"
 	"io"
 
 	gzip "github.com/klauspost/pgzip"
@@ -8,6 +9,10 @@ import (
 
 const cWINDOW_SIZE = 4096
 
+// Maximum compressed size of the members kept in memory to fill in their size
+// hint, when the options do not bound the size of the members.
+const maxBufferedMemberSize = 1024 * 1024
+
 type countWriter struct {
 	io.Writer
 	off int64
@@ -22,10 +27,13 @@ func (cw *countWriter) Write(data []byte) (int, error) {
 type GzipWriterRsyncable struct {
 	*gzip.Writer
 	underw *countWriter
-	window []byte
+	buf    *memberBuffer
+	hash   roller
 	idx    int
-	sum    int
 	blk    int64
+	log    *memberLog
+	opts   WriterOptions
+	closed bool
 }
 
 // Create a new compressing writer that will generate a multi-gzip, segmenting
@@ -38,57 +46,186 @@ type GzipWriterRsyncable struct {
 // other words, we use the same algorithm of "gzip --rsyncable", but for a
 // multigz file.
 func NewWriterLevelRsyncable(w io.Writer, level int) (Writer, error) {
-	underw := &countWriter{Writer: w}
-	bg, err := gzip.NewWriterLevel(underw, level)
-	if err != nil {
+	return NewWriterLevelRsyncableOptions(w, level, nil)
+}
+
+// Create a new rsync-friendly compressing writer like NewWriterLevelRsyncable,
+// but with additional options; see WriterOptions for the available ones. In
+// particular, the segmenting algorithm can be tuned with the Hash,
+// WindowSize, AvgBlockSize, MinBlockSize and MaxBlockSize options.
+func NewWriterLevelRsyncableOptions(w io.Writer, level int, opts *WriterOptions) (Writer, error) {
+	rw := new(GzipWriterRsyncable)
+	if opts != nil {
+		rw.opts = *opts
+	}
+	if rw.opts.WindowSize == 0 {
+		rw.opts.WindowSize = cWINDOW_SIZE
+	}
+	if rw.opts.AvgBlockSize == 0 {
+		rw.opts.AvgBlockSize = cWINDOW_SIZE
+	}
+	if rw.opts.WindowSize < 0 {
+		return nil, errInvalidOptions
+	}
+	hash := newRoller(rw.opts.Hash, rw.opts.WindowSize, rw.opts.AvgBlockSize)
+	if err := rw.init(w, level, hash); err != nil {
 		return nil, err
 	}
-	return &GzipWriterRsyncable{
-		Writer: bg,
-		underw: underw,
-		window: make([]byte, cWINDOW_SIZE),
-	}, nil
+	return rw, nil
 }
 
-func (w *GzipWriterRsyncable) Write(data []byte) (int, error) {
+// init sets up a writer that segments the stream where the rolling hash
+// says so, within the block size bounds specified in the options.
+func (rw *GzipWriterRsyncable) init(w io.Writer, level int, hash roller) error {
+	if rw.opts.AvgBlockSize < 0 || rw.opts.MinBlockSize < 0 || rw.opts.MaxBlockSize < 0 ||
+		(rw.opts.MaxBlockSize > 0 && rw.opts.MaxBlockSize < rw.opts.MinBlockSize) {
+		return errInvalidOptions
+	}
 
-	written := 0
-Start:
-	d := data
-	for w.idx < cWINDOW_SIZE && len(d) > 0 {
-		w.window[w.idx] = d[0]
-		w.sum += int(d[0])
-		w.idx++
-		d = d[1:]
+	rw.underw = &countWriter{Writer: w}
+	rw.log = newMemberLog()
+	rw.hash = hash
+
+	// Members are generated in memory to fill in their size hint. If their
+	// size is not bounded by the options, those that grow too much are
+	// streamed out without a size hint.
+	rw.buf = &memberBuffer{w: rw.underw}
+	if rw.opts.MaxBlockSize == 0 {
+		rw.buf.limit = maxBufferedMemberSize
+	}
+	bg, err := gzip.NewWriterLevel(rw.buf, level)
+	if err != nil {
+		return err
 	}
-	for len(d) > 0 {
-		w.sum -= int(w.window[w.idx%cWINDOW_SIZE])
-		w.window[w.idx%cWINDOW_SIZE] = d[0]
-		w.sum += int(w.window[w.idx%cWINDOW_SIZE])
+	rw.Writer = bg
+	rw.startMember()
+	return nil
+}
+
+// startMember sets up the header of a new member.
+func (w *GzipWriterRsyncable) startMember() {
+	w.Writer.Extra = newSizeHint()
+}
+
+func (w *GzipWriterRsyncable) Write(data []byte) (int, error) {
+	written := 0
+	for i := 0; i < len(data); i++ {
+		w.hash.roll(data[i])
 		w.idx++
-		d = d[1:]
-		if w.sum%cWINDOW_SIZE == 0 {
-			d1 := len(data) - len(d)
-			n, err := w.Writer.Write(data[:d1])
+		if (w.idx >= w.opts.MinBlockSize && w.hash.split()) ||
+			(w.opts.MaxBlockSize > 0 && w.idx >= w.opts.MaxBlockSize) {
+			n, err := w.Writer.Write(data[:i+1])
 			written += n
+			w.log.write(data[:n])
 			if err != nil {
-				return 0, err
+				return written, err
 			}
-			w.Writer.Flush()
-			w.Writer.Close()
-			w.Writer.Reset(w.underw)
-			w.sum = 0
-			w.idx = 0
-			w.blk = w.underw.off
-			data = data[d1:]
-			goto Start
+			if err := w.cut(); err != nil {
+				return written, err
+			}
+			data = data[i+1:]
+			i = -1
 		}
 	}
 
 	n, err := w.Writer.Write(data)
+	w.log.write(data[:n])
 	return written + n, err
 }
 
+// cut closes the current gzip member, and starts a new one.
+func (w *GzipWriterRsyncable) cut() error {
+	w.Writer.Flush()
+	w.Writer.Close()
+	if err := w.flushMember(); err != nil {
+		return err
+	}
+	w.Writer.Reset(w.buf)
+	w.startMember()
+	w.hash.reset()
+	w.idx = 0
+	w.blk = w.underw.off
+	return nil
+}
+
+// Cut closes the current gzip member, and starts a new one; see Cutter.
+func (w *GzipWriterRsyncable) Cut() error {
+	if w.idx == 0 {
+		return nil
+	}
+	return w.cut()
+}
+
+// Close closes the last gzip member, and writes the embedded index if it
+// was requested. It does not close the underlying io.Writer.
+func (w *GzipWriterRsyncable) Close() error {
+	if w.closed {
+		return nil
+	}
+	// Avoid a trailing empty member, if the stream ended with a cut
+	if w.idx > 0 || len(w.log.idx.Members) == 0 {
+		if err := w.Writer.Close(); err != nil {
+			return err
+		}
+		if err := w.flushMember(); err != nil {
+			return err
+		}
+	}
+	w.closed = true
+	if w.opts.EmbedIndex {
+		return writeIndexMembers(w.underw, &w.log.idx)
+	}
+	return nil
+}
+
+// flushMember writes out the member that has just been closed, and records
+// it in the index.
+func (w *GzipWriterRsyncable) flushMember() error {
+	if err := w.buf.flush(); err != nil {
+		return err
+	}
+	w.log.end(w.blk, w.underw.off)
+	return nil
+}
+
+// A memberBuffer keeps the gzip member being compressed in memory, so that
+// its size hint can be filled in before writing it out to w. If the member
+// grows beyond limit bytes (when limit is not zero), it is streamed out
+// instead, and its size hint is left as a zero placeholder, which readers
+// ignore.
+type memberBuffer struct {
+	bytes.Buffer
+	w        io.Writer
+	limit    int
+	streamed bool
+}
+
+func (mb *memberBuffer) Write(data []byte) (int, error) {
+	if !mb.streamed {
+		if mb.limit == 0 || mb.Len()+len(data) <= mb.limit {
+			return mb.Buffer.Write(data)
+		}
+		mb.streamed = true
+		if _, err := mb.w.Write(mb.Bytes()); err != nil {
+			return 0, err
+		}
+		mb.Reset()
+	}
+	return mb.w.Write(data)
+}
+
+// flush writes out the rest of the member, filling in its size hint if it
+// was kept in memory as a whole.
+func (mb *memberBuffer) flush() error {
+	if !mb.streamed {
+		patchSizeHint(mb.Bytes())
+	}
+	_, err := mb.w.Write(mb.Bytes())
+	mb.Reset()
+	mb.streamed = false
+	return err
+}
+
 func (w *GzipWriterRsyncable) Offset() Offset {
 	return Offset{
 		Block: int64(w.blk),
@@ -0,0 +1,143 @@
+package multigz
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrNotFound is returned by Search when no record matches.
+	ErrNotFound = errors.New("record not found")
+)
+
+// Search looks for a record in a multi-gzip made of newline-terminated
+// records sorted in ascending order, like a sorted TSV file or sorted JSON
+// lines. cmp is called with a record (without the newline), and it must
+// return a negative number if the record sorts before the one that is being
+// looked for, zero if it matches, and a positive number if it sorts after.
+//
+// Search returns the first matching record, and its position in the
+// decompressed stream. It binary-searches the members using their first
+// record (which is decoded once, and then kept in r), and then scans only
+// the member that can contain the record, so each member must begin with a
+// whole record: write the file with the WriterOptions.Split option. Use
+// ReaderAt.SetCache to speed up repeated searches. cmp must not modify the
+// record.
+func Search(r *ReaderAt, cmp func(record []byte) int) ([]byte, int64, error) {
+	members := r.idx.Members
+
+	// Find the first member whose first record does not sort before the
+	// searched one. Empty members are judged by the next non-empty one.
+	var err error
+	j := sort.Search(len(members), func(i int) bool {
+		for i < len(members) && members[i].Size == 0 {
+			i++
+		}
+		if err != nil || i == len(members) {
+			return true
+		}
+		var rec []byte
+		rec, err = memberFirstRecord(r, &members[i])
+		if err != nil {
+			return true
+		}
+		return cmp(rec) >= 0
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The record is either within the last non-empty member before j, or
+	// it is the first record of the first non-empty member from j.
+	prev := j - 1
+	for prev >= 0 && members[prev].Size == 0 {
+		prev--
+	}
+	if prev >= 0 {
+		m := &members[prev]
+		data, err := memberData(r, m)
+		if err != nil {
+			return nil, 0, err
+		}
+		for pos := 0; pos < len(data); {
+			rec := firstRecord(data[pos:])
+			if c := cmp(rec); c >= 0 {
+				if c > 0 {
+					return nil, 0, ErrNotFound
+				}
+				return rec, m.Start + int64(pos), nil
+			}
+			pos += len(rec) + 1
+		}
+	}
+	for j < len(members) && members[j].Size == 0 {
+		j++
+	}
+	if j < len(members) {
+		m := &members[j]
+		rec, err := memberFirstRecord(r, m)
+		if err != nil {
+			return nil, 0, err
+		}
+		if cmp(rec) == 0 {
+			return append([]byte(nil), rec...), m.Start, nil
+		}
+	}
+	return nil, 0, ErrNotFound
+}
+
+// memberFirstRecord returns the first record of member m, decompressing
+// only the beginning of the member, and caching the record in r. The
+// returned record must not be modified.
+func memberFirstRecord(r *ReaderAt, m *Member) ([]byte, error) {
+	r.mu.Lock()
+	rec, ok := r.firsts[m.Block]
+	r.mu.Unlock()
+	if ok {
+		return rec, nil
+	}
+
+	// Read increasingly bigger chunks, until the first newline
+	var data []byte
+	for n := int64(4096); ; n *= 2 {
+		if n > m.Size {
+			n = m.Size
+		}
+		chunk := make([]byte, n-int64(len(data)))
+		if _, err := r.ReadAt(chunk, m.Start+int64(len(data))); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if bytes.IndexByte(chunk, '\n') >= 0 || n == m.Size {
+			break
+		}
+	}
+
+	// Copy the record, not to keep the whole chunk in memory
+	rec = append([]byte(nil), firstRecord(data)...)
+	r.mu.Lock()
+	if r.firsts == nil || len(r.firsts) >= maxFirstRecords {
+		r.firsts = make(map[int64][]byte)
+	}
+	r.firsts[m.Block] = rec
+	r.mu.Unlock()
+	return rec, nil
+}
+
+// memberData returns the decompressed data of member m.
+func memberData(r *ReaderAt, m *Member) ([]byte, error) {
+	data := make([]byte, m.Size)
+	if _, err := r.ReadAt(data, m.Start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// firstRecord returns the first record in data, without the newline.
+func firstRecord(data []byte) []byte {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return data[:i]
+	}
+	return data
+}
@@ -0,0 +1,86 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/bits"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	// Sorted records with even keys only, written in two halves. Empty
+	// gzip members (like those of other tools) are added at the beginning,
+	// between the halves and at the end.
+	var data bytes.Buffer
+	const nrecords = 20000
+	for i := 0; i < nrecords; i++ {
+		fmt.Fprintf(&data, "%08d\tvalue %d\n", i*2, i)
+	}
+	half := bytes.Index(data.Bytes(), []byte(fmt.Sprintf("%08d\t", nrecords)))
+
+	var buf bytes.Buffer
+	for _, chunk := range [][]byte{nil, data.Bytes()[:half], nil, data.Bytes()[half:], nil} {
+		if chunk == nil {
+			gz := gzip.NewWriter(&buf)
+			if err := gz.Close(); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		w, err := NewWriterLevelOptions(&buf, -1, 4096, &WriterOptions{Split: SplitDelimiter('\n')})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ra, err := NewReaderAt(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.SetCache(NewBlockCache(1024*1024), "records")
+	if len(ra.Index().Members) < 10 {
+		t.Fatal("too few members:", len(ra.Index().Members))
+	}
+
+	search := func(key int) ([]byte, int64, error) {
+		k := []byte(fmt.Sprintf("%08d", key))
+		return Search(ra, func(rec []byte) int {
+			return bytes.Compare(rec[:8], k)
+		})
+	}
+
+	// A single search probes (and decodes the first record of) only a
+	// logarithmic number of members.
+	search(nrecords)
+	probed := len(ra.firsts)
+	if probed > 2*bits.Len(uint(len(ra.Index().Members)))+2 {
+		t.Errorf("probed %d members of %d", probed, len(ra.Index().Members))
+	}
+
+	for key := -1; key <= nrecords*2; key++ {
+		rec, pos, err := search(key)
+		if key%2 != 0 || key < 0 || key >= nrecords*2 {
+			if err != ErrNotFound {
+				t.Fatalf("key %d: found %q (%v)", key, rec, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("key %d: %v", key, err)
+		}
+		want := fmt.Sprintf("%08d\tvalue %d", key, key/2)
+		if string(rec) != want {
+			t.Fatalf("key %d: found %q", key, rec)
+		}
+		if !bytes.HasPrefix(data.Bytes()[pos:], []byte(want+"\n")) {
+			t.Fatalf("key %d: invalid position %d", key, pos)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package multigz
+
+import (
+	"io"
+)
+
+// Split copies the multi-gzip r into multiple parts, cutting it only at
+// member boundaries, so that every part is a valid multi-gzip (and gzip)
+// file on its own. The members are copied verbatim, without recompressing
+// them. Each part is at most maxPartSize bytes long, unless it is made of a
+// single member bigger than that.
+//
+// next is called to get the writer for each part, numbered from zero.
+// Split returns the Index of each part, with offsets relative to the part;
+// they can be stored next to the parts (see Index.WriteTo) or appended to
+// them (see WriteEmbeddedIndex). The embedded index of r, if any, is not
+// copied.
+func Split(r io.ReadSeeker, maxPartSize int64, next func(part int) (io.Writer, error)) ([]*Index, error) {
+	idx, err := ReadEmbeddedIndex(r)
+	if err != nil {
+		if idx, err = BuildIndex(r); err != nil {
+			return nil, err
+		}
+	}
+
+	// Group the members into parts
+	var parts []*Index
+	var part *Index
+	for _, m := range idx.Members {
+		if part == nil || m.Block+m.BlockSize-part.Members[0].Block > maxPartSize {
+			part = new(Index)
+			parts = append(parts, part)
+		}
+		part.Members = append(part.Members, m)
+	}
+
+	for i, part := range parts {
+		first := part.Members[0]
+		size := part.CompressedSize() - first.Block
+		if _, err := r.Seek(first.Block, io.SeekStart); err != nil {
+			return nil, err
+		}
+		w, err := next(i)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return nil, err
+		}
+
+		// Make the index relative to the part
+		for j := range part.Members {
+			part.Members[j].Block -= first.Block
+			part.Members[j].Start -= first.Start
+		}
+	}
+	return parts, nil
+}
@@ -0,0 +1,66 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	data := loadDivina(t)
+
+	var src bytes.Buffer
+	w, err := NewWriterLevelOptions(&src, -1, 16384, &WriterOptions{EmbedIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const maxPart = 50000
+	var outs []*bytes.Buffer
+	parts, err := Split(bytes.NewReader(src.Bytes()), maxPart, func(i int) (io.Writer, error) {
+		if i != len(outs) {
+			t.Fatal("invalid part number:", i)
+		}
+		outs = append(outs, new(bytes.Buffer))
+		return outs[i], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 || len(parts) != len(outs) {
+		t.Fatal("invalid number of parts:", len(parts), len(outs))
+	}
+
+	var all []byte
+	for i, out := range outs {
+		if out.Len() > maxPart {
+			t.Errorf("part %d is too big: %d", i, out.Len())
+		}
+		if err := parts[i].Verify(bytes.NewReader(out.Bytes())); err != nil {
+			t.Errorf("part %d: %v", i, err)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(d)) != parts[i].Size() {
+			t.Errorf("part %d: invalid size in index", i)
+		}
+		all = append(all, d...)
+	}
+	if !bytes.Equal(all, data) {
+		t.Error("invalid data in parts")
+	}
+}
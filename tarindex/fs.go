@@ -0,0 +1,291 @@
+package tarindex
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+var (
+	errIsDir         = errors.New("is a directory")
+	errNotDir        = errors.New("not a directory")
+	errInvalidWhence = errors.New("invalid whence value")
+	errNegativeSeek  = errors.New("negative position")
+)
+
+// FS is a read-only file system with the contents of a tar archive within a
+// multi-gzip. It implements fs.FS, fs.ReadDirFS and fs.StatFS, so it can be
+// used with http.FS, template.ParseFS, fs.WalkDir and so on.
+//
+// Files are not extracted: reading a file seeks the multigz.Reader to its
+// data, decompressing at most one gzip member that is not part of the file.
+// Files opened from the same FS share the multigz.Reader, so they can be
+// read from multiple goroutines, but their reads are serialized. Directories
+// that are not stored in the archive, but are implied by the path of its
+// files, are listed as well. Links are followed, so they appear as the
+// files or directories they point to.
+type FS struct {
+	idx  *Index
+	dirs map[string][]string
+}
+
+// NewFS creates a FS over the archive described by idx. The FS uses the
+// multigz.Reader of idx, which must not be used concurrently by other code,
+// except for the readers returned by idx.Open. If the multigz.Reader has no
+// block index yet, NewFS builds it, so that reads can seek within the files.
+func NewFS(idx *Index) (*FS, error) {
+	if idx.r.Index() == nil {
+		idx.mu.Lock()
+		_, err := idx.r.Seek(0, io.SeekStart)
+		idx.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	children := map[string]map[string]bool{".": {}}
+	var add func(name string)
+	add = func(name string) {
+		dir := path.Dir(name)
+		if children[dir] == nil {
+			children[dir] = make(map[string]bool)
+			add(dir)
+		}
+		children[dir][name] = true
+	}
+	for _, e := range idx.Entries {
+		name := cleanName(e.Header.Name)
+		if name == "" {
+			continue
+		}
+		add(name)
+		if e.Header.Typeflag == tar.TypeDir && children[name] == nil {
+			children[name] = make(map[string]bool)
+		}
+	}
+
+	fsys := &FS{idx: idx, dirs: make(map[string][]string)}
+	for dir, names := range children {
+		list := make([]string, 0, len(names))
+		for name := range names {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		fsys.dirs[dir] = list
+	}
+	return fsys, nil
+}
+
+// Open opens the named file or directory.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	target, e, fi, err := fsys.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if fi.IsDir() {
+		return &dir{fsys: fsys, name: name, target: target, info: fi}, nil
+	}
+	if e.Header.Typeflag != tar.TypeReg {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errNotRegular}
+	}
+	return &file{entryReader: entryReader{idx: fsys.idx, e: e}, name: name, info: fi}, nil
+}
+
+// Stat returns a FileInfo describing the named file or directory.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	_, _, fi, err := fsys.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
+// ReadDir reads the named directory, and returns its entries sorted by
+// filename.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	list, err := fsys.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return list, nil
+}
+
+// stat resolves the links in name, and returns the name it leads to, its
+// Entry (if it is stored in the archive) and its FileInfo, which is always
+// named after name.
+func (fsys *FS) stat(name string) (string, *Entry, fs.FileInfo, error) {
+	target, e, err := fsys.idx.resolve(name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if target == "" {
+		target = "."
+	}
+	var fi fs.FileInfo
+	if _, isdir := fsys.dirs[target]; isdir {
+		if e != nil && e.Header.Typeflag == tar.TypeDir {
+			fi = e.Header.FileInfo()
+		} else {
+			fi = dirInfo(target)
+		}
+	} else if e != nil {
+		fi = e.Header.FileInfo()
+	} else {
+		return "", nil, nil, fs.ErrNotExist
+	}
+	if target != name {
+		fi = linkInfo{fi, path.Base(name)}
+	}
+	return target, e, fi, nil
+}
+
+func (fsys *FS) readDir(name string) ([]fs.DirEntry, error) {
+	target, _, fi, err := fsys.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errNotDir
+	}
+	children := fsys.dirs[target]
+	list := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		_, _, fi, err := fsys.stat(child)
+		if err != nil {
+			// A broken link: list the link itself
+			e, ok := fsys.idx.Lookup(child)
+			if !ok {
+				return nil, err
+			}
+			fi = e.Header.FileInfo()
+		}
+		list = append(list, fs.FileInfoToDirEntry(fi))
+	}
+	return list, nil
+}
+
+// dirInfo describes a directory that is not stored in the archive.
+type dirInfo string
+
+func (di dirInfo) Name() string       { return path.Base(string(di)) }
+func (di dirInfo) Size() int64        { return 0 }
+func (di dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (di dirInfo) ModTime() time.Time { return time.Time{} }
+func (di dirInfo) IsDir() bool        { return true }
+func (di dirInfo) Sys() interface{}   { return nil }
+
+// linkInfo describes the target of a link, under the name of the link.
+type linkInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (li linkInfo) Name() string { return li.name }
+
+// file is an open file of a FS.
+type file struct {
+	entryReader
+	name   string
+	info   fs.FileInfo
+	closed bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.entryReader.Read(p)
+}
+
+// Seek sets the position of the next Read within the file.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.e.Header.Size
+	default:
+		return 0, errInvalidWhence
+	}
+	if pos < 0 {
+		return 0, errNegativeSeek
+	}
+	f.seek(pos)
+	return pos, nil
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// dir is an open directory of a FS.
+type dir struct {
+	fsys    *FS
+	name    string
+	target  string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		list, err := d.fsys.readDir(d.target)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.entries, d.read = list, true
+	}
+	if n <= 0 {
+		list := d.entries
+		d.entries = nil
+		return list, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	list := d.entries[:n]
+	d.entries = d.entries[n:]
+	return list, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package tarindex
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rasky/multigz"
+)
+
+func TestFS(t *testing.T) {
+	archive, files := makeArchive(t)
+
+	r, err := multigz.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := Build(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	if err := fstest.TestFS(fsys, names...); err != nil {
+		t.Fatal(err)
+	}
+
+	// dir/sub is not stored in the archive
+	fi, err := fs.Stat(fsys, "dir/sub")
+	if err != nil || !fi.IsDir() {
+		t.Fatal("implicit directory not found:", err)
+	}
+
+	// Interleave reads and seeks on two files
+	a, _ := fsys.Open("dir/file01.txt")
+	b, _ := fsys.Open("dir/file02.txt")
+	da, db := files["dir/file01.txt"], files["dir/file02.txt"]
+	buf := make([]byte, 1000)
+	for _, pos := range []int64{0, 5000, 1000, 20000, 3} {
+		for _, f := range []struct {
+			f    fs.File
+			data []byte
+		}{{a, da}, {b, db}} {
+			if pos+int64(len(buf)) > int64(len(f.data)) {
+				continue
+			}
+			f.f.(io.Seeker).Seek(pos, io.SeekStart)
+			if _, err := io.ReadFull(f.f, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, f.data[pos:pos+int64(len(buf))]) {
+				t.Error("invalid data at", pos)
+			}
+		}
+	}
+
+	// Read concurrently through the FS and through the Index
+	var wg sync.WaitGroup
+	for name, data := range files {
+		wg.Add(2)
+		go func(name string, data []byte) {
+			defer wg.Done()
+			if got, err := fs.ReadFile(fsys, name); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: invalid content from the FS: %v", name, err)
+			}
+		}(name, data)
+		go func(name string, data []byte) {
+			defer wg.Done()
+			f, err := idx.Open(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: invalid content from the Index: %v", name, err)
+			}
+		}(name, data)
+	}
+	wg.Wait()
+}
+
+func TestFSLinks(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := multigz.NewWriterLevel(&buf, -1, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+	content := []byte("hello, links\n")
+	for _, hdr := range []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "a/file.txt"},
+		{Name: "a/sym", Typeflag: tar.TypeSymlink, Linkname: "file.txt"},
+		{Name: "dirlink", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "outside", Typeflag: tar.TypeSymlink, Linkname: "../etc/passwd"},
+		{Name: "loop1", Typeflag: tar.TypeSymlink, Linkname: "loop2"},
+		{Name: "loop2", Typeflag: tar.TypeSymlink, Linkname: "loop1"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(content); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := multigz.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := Build(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"hard", "a/sym", "dirlink/file.txt", "dirlink/sym"} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%s: invalid content %q: %v", name, data, err)
+		}
+	}
+	if f, err := idx.Open("hard"); err != nil {
+		t.Error(err)
+	} else if data, _ := ioutil.ReadAll(f); !bytes.Equal(data, content) {
+		t.Errorf("hard: invalid content %q", data)
+	}
+
+	if fi, err := fs.Stat(fsys, "dirlink"); err != nil || !fi.IsDir() || fi.Name() != "dirlink" {
+		t.Error("dirlink: invalid stat:", fi, err)
+	}
+	if list, err := fs.ReadDir(fsys, "dirlink"); err != nil || len(list) != 2 {
+		t.Error("dirlink: invalid listing:", list, err)
+	}
+	for _, name := range []string{"outside", "loop1"} {
+		if _, err := fs.ReadFile(fsys, name); err == nil {
+			t.Error(name, "opened")
+		}
+	}
+	if _, err := fs.ReadDir(fsys, "."); err != nil {
+		t.Error("broken links break the listing:", err)
+	}
+}
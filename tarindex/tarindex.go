@@ -0,0 +1,255 @@
+// Package tarindex gives random access to the files stored in a tar archive
+// compressed as a multi-gzip (for instance, with "tar c dir | multigz -c").
+//
+// The archive is scanned once to build an Index, which records where the
+// data of each file begins in the decompressed stream, as a multigz.Offset.
+// If the multigz.Reader has a block index, the scan seeks over the contents
+// of the files, so that only the members holding tar headers are
+// decompressed. Afterwards, a single file can be read by seeking directly
+// to it, which requires decompressing at most one gzip member of data that
+// is not part of the file. The archive can also be accessed as a fs.FS, see
+// NewFS.
+//
+// Hard and symbolic links are followed, as long as they point to other
+// entries of the archive.
+package tarindex
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/rasky/multigz"
+)
+
+var (
+	errNotRegular   = errors.New("not a regular file")
+	errTooManyLinks = errors.New("too many levels of links")
+)
+
+// maxLinks is the maximum number of links followed to resolve a name.
+const maxLinks = 40
+
+// Entry describes a single entry of the tar archive. Offset points to the
+// data of the entry (that is, just after its tar header), and can be passed
+// to multigz.Reader.SeekOffset; Pos is the same position, as absolute
+// position in the decompressed stream.
+type Entry struct {
+	Header *tar.Header
+	Offset multigz.Offset
+	Pos    int64
+}
+
+// countReader counts the bytes read through it. It also hides Reader.Seek
+// from archive/tar, which would use it to skip the file contents: it works
+// over absolute positions, so it would need to build the block index of
+// the multi-gzip first.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(data []byte) (int, error) {
+	n, err := cr.r.Read(data)
+	cr.n += int64(n)
+	return n, err
+}
+
+// seekReader is a countReader that lets archive/tar skip the file contents
+// with Reader.Seek, for Readers that already have a block index.
+type seekReader struct {
+	*countReader
+	r *multigz.Reader
+}
+
+func (sr *seekReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := sr.r.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	sr.n = pos
+	return pos, nil
+}
+
+// Index is the list of the entries of a tar archive within a multi-gzip, in
+// archive order.
+type Index struct {
+	Entries []Entry
+
+	// mu serializes the accesses to r by the readers of the entries
+	mu     sync.Mutex
+	r      *multigz.Reader
+	byName map[string]int
+}
+
+// Build scans the whole tar archive from the current position of r, which
+// should be at the beginning of the decompressed stream, and returns an
+// Index of its entries. The Index keeps using r to read the entries.
+//
+// If r has a block index (see multigz.Reader.SetIndex), Build seeks over
+// the contents of the files instead of decompressing them.
+func Build(r *multigz.Reader) (*Index, error) {
+	cr := &countReader{r: r}
+	tr := tar.NewReader(cr)
+	if r.Index() != nil {
+		tr = tar.NewReader(&seekReader{countReader: cr, r: r})
+	}
+
+	idx := &Index{r: r, byName: make(map[string]int)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// archive/tar reads exactly up to the end of the header, so the
+		// current offset points to the data of the entry.
+		idx.byName[cleanName(hdr.Name)] = len(idx.Entries)
+		idx.Entries = append(idx.Entries, Entry{Header: hdr, Offset: r.Offset(), Pos: cr.n})
+	}
+	return idx, nil
+}
+
+// cleanName normalizes the name of an entry, so that "./dir/file",
+// "/dir/file" and "dir/file" all refer to the same file.
+func cleanName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// Lookup returns the Entry with the given name. If the archive contains
+// multiple entries with the same name, the last one is returned, as tar
+// would do when extracting the archive.
+func (idx *Index) Lookup(name string) (*Entry, bool) {
+	i, ok := idx.byName[cleanName(name)]
+	if !ok {
+		return nil, false
+	}
+	return &idx.Entries[i], true
+}
+
+// resolve follows the hard and symbolic links in name (also in its
+// directories), and returns the name and the Entry they lead to. The Entry
+// is nil if there is no entry with that name, which might still be a
+// directory implied by the names of other entries. Links that point outside
+// of the archive are reported as fs.ErrNotExist.
+func (idx *Index) resolve(name string) (string, *Entry, error) {
+	var resolved string
+	rest := cleanName(name)
+	for links := 0; rest != ""; {
+		elem := rest
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			elem, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		cur := path.Join(resolved, elem)
+		e, ok := idx.Lookup(cur)
+		if !ok || (e.Header.Typeflag != tar.TypeLink && e.Header.Typeflag != tar.TypeSymlink) {
+			resolved = cur
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", nil, errTooManyLinks
+		}
+		// Hard links are relative to the root of the archive, symbolic
+		// links to the directory containing them.
+		target := e.Header.Linkname
+		if e.Header.Typeflag == tar.TypeSymlink && !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		if target = path.Clean(target); target == ".." || strings.HasPrefix(target, "../") {
+			return "", nil, fs.ErrNotExist
+		}
+		resolved, rest = "", cleanName(path.Join(target, rest))
+	}
+
+	e, ok := idx.Lookup(resolved)
+	if !ok {
+		return resolved, nil, nil
+	}
+	return resolved, e, nil
+}
+
+// Open returns a reader for the contents of the regular file with the given
+// name, following links. The returned reader reads from the underlying
+// multigz.Reader: reads from multiple readers (also from different
+// goroutines) are serialized, and each one moves the multigz.Reader back to
+// where the previous read of the same reader stopped, if needed. The
+// multigz.Reader must not be used by other code in the meantime.
+func (idx *Index) Open(name string) (io.Reader, error) {
+	_, e, err := idx.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if e == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.Header.Typeflag != tar.TypeReg {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errNotRegular}
+	}
+	return &entryReader{idx: idx, e: e}, nil
+}
+
+// entryReader reads the data of an Entry. It keeps the Offset of its
+// current position, so that sequential reads do not need to seek again,
+// unless other readers used the multigz.Reader in the meantime.
+type entryReader struct {
+	idx   *Index
+	e     *Entry
+	pos   int64
+	cur   multigz.Offset
+	valid bool
+}
+
+func (er *entryReader) Read(p []byte) (int, error) {
+	left := er.e.Header.Size - er.pos
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	er.idx.mu.Lock()
+	defer er.idx.mu.Unlock()
+
+	r := er.idx.r
+	var err error
+	switch {
+	case er.valid:
+		err = r.SeekOffset(er.cur)
+	case er.pos == 0:
+		err = r.SeekOffset(er.e.Offset)
+	default:
+		// Use the block index of the multi-gzip (building it if
+		// needed) to avoid decompressing the file from its beginning
+		_, err = r.Seek(er.e.Pos+er.pos, io.SeekStart)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r, p)
+	er.pos += int64(n)
+	er.cur, er.valid = r.Offset(), true
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// seek moves the position of the next Read to pos.
+func (er *entryReader) seek(pos int64) {
+	if pos != er.pos {
+		er.pos = pos
+		er.valid = false
+	}
+}
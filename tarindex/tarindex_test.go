@@ -0,0 +1,179 @@
+package tarindex
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/rasky/multigz"
+)
+
+// makeArchive creates a tar.gz multi-gzip with some random files, and
+// returns it together with the contents of the files.
+func makeArchive(t *testing.T) ([]byte, map[string][]byte) {
+	files := make(map[string][]byte)
+	var buf bytes.Buffer
+	w, err := multigz.NewWriterLevel(&buf, -1, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+
+	rnd := rand.New(rand.NewSource(1))
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("dir/file%02d.txt", i)
+		if i%10 == 0 {
+			name = fmt.Sprintf("dir/sub/file%02d.txt", i)
+		}
+		data := make([]byte, rnd.Intn(40000))
+		for j := range data {
+			data[j] = byte('a' + rnd.Intn(4))
+		}
+		files[name] = data
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), files
+}
+
+func TestIndex(t *testing.T) {
+	archive, files := makeArchive(t)
+
+	r, err := multigz.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := Build(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != len(files)+1 {
+		t.Fatal("invalid number of entries:", len(idx.Entries))
+	}
+
+	// Open the files in random order
+	perm := rand.Perm(len(idx.Entries))
+	for _, i := range perm {
+		e := idx.Entries[i]
+		f, err := idx.Open("./" + e.Header.Name)
+		if e.Header.Typeflag == tar.TypeDir {
+			if err == nil {
+				t.Error("opened a directory:", e.Header.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, files[e.Header.Name]) {
+			t.Error("invalid content for", e.Header.Name)
+		}
+	}
+
+	if _, err := idx.Open("missing"); !os.IsNotExist(err) {
+		t.Error("invalid error for missing file:", err)
+	}
+}
+
+// countingReader counts the compressed bytes read from the archive.
+type countingReader struct {
+	*bytes.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(data []byte) (int, error) {
+	n, err := cr.Reader.Read(data)
+	cr.n += int64(n)
+	return n, err
+}
+
+func TestBuildSeek(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := multigz.NewWriterLevel(&buf, -1, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(w)
+	rnd := rand.New(rand.NewSource(1))
+	files := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("big%d.bin", i)
+		data := make([]byte, 1024*1024)
+		for j := range data {
+			data[j] = byte('a' + rnd.Intn(4))
+		}
+		files[name] = data
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	mi, err := multigz.BuildIndex(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := &countingReader{Reader: bytes.NewReader(archive)}
+	r, err := multigz.NewReader(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetIndex(mi)
+	idx, err := Build(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the members with the tar headers should have been read
+	if cr.n > int64(len(archive))/4 {
+		t.Errorf("read %d bytes of %d to build the index", cr.n, len(archive))
+	}
+
+	for name, data := range files {
+		e, _ := idx.Lookup(name)
+		if pos, _ := mi.Pos(e.Offset); pos != e.Pos {
+			t.Errorf("%s: inconsistent position %d, offset %v", name, e.Pos, e.Offset)
+		}
+		f, err := idx.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("invalid content for", name)
+		}
+	}
+}
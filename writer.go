@@ -1,18 +1,27 @@
 package multigz
 
-import "io"
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
 
 // This interface represents an object that generates a multi-gzip file.
 // In addition of implementing a standard WriteCloser, it also gives access
 // to a Offset method for fetching a pointer to the current position in the
 // stream.
 //
-// In the current version, there are two different implementations of Writer:
+// In the current version, there are three different implementations of Writer:
 //
 //  - A writer that segments the multi-gzip file based on a fixed block
 //    size. Create it with NewWriterLevel().
 //  - A writer that segments the multi-gzip file making it more friendly
 //    to rsync and binary-diffs. Create it wtih NewRsyncableWriter().
+//  - A writer that segments the multi-gzip file with FastCDC, making
+//    blocks stable across changes, for deduplication. Create it with
+//    NewWriterLevelFastCDC().
 //
 type Writer interface {
 	io.WriteCloser
@@ -21,3 +30,115 @@ type Writer interface {
 	// decompressed stream.
 	Offset() Offset
 }
+
+// Cutter is implemented by the Writers that can close the current gzip
+// member on request, which includes all the Writers of this package. Use a
+// type assertion to get it from a Writer.
+type Cutter interface {
+	// Cut closes the current gzip member and starts a new one, so that
+	// Offset() afterwards returns an Offset with Off equal to zero,
+	// which can be seeked to without decompressing anything. It does
+	// nothing if the current member is empty.
+	Cut() error
+}
+
+// WriterOptions configures the optional features of the Writers. A nil
+// *WriterOptions is equivalent to the zero value, which selects the default
+// behaviour.
+type WriterOptions struct {
+	// EmbedIndex appends the block index of the file at the end of the
+	// multi-gzip, within an additional gzip member with an empty payload
+	// that is ignored by gzip-compatible decompressors. Reader.Seek
+	// detects it and uses it for seeking. See also ReadEmbeddedIndex.
+	EmbedIndex bool
+
+	// Workers is the number of goroutines used to compress blocks in
+	// parallel by the fixed-size writer (NewWriterLevelOptions). The
+	// output does not depend on it. Zero or one means that blocks are
+	// compressed serially.
+	Workers int
+
+	// Hash selects the rolling hash used by the rsyncable writer to find
+	// the segmenting points; see RollingHash. The default is HashSum, the
+	// same algorithm used by "gzip --rsyncable".
+	Hash RollingHash
+
+	// WindowSize is the number of bytes considered by the rolling hash of
+	// the rsyncable writer. The default is 4096.
+	WindowSize int
+
+	// AvgBlockSize is the target average size of the blocks segmented by
+	// the rsyncable writer (the default is 4096) and by the FastCDC writer
+	// (the default is DefaultBlockSize).
+	AvgBlockSize int
+
+	// MinBlockSize and MaxBlockSize bound the size of the blocks
+	// segmented by the rsyncable and FastCDC writers (in uncompressed
+	// bytes). Zero means no bound for the rsyncable writer, and the
+	// default bounds for the FastCDC writer. MaxBlockSize also bounds the
+	// blocks of the fixed-size writer when Split is used (by default, to
+	// 4 times the block size). The rsyncable writer keeps each member in
+	// memory to store its size hint; if MaxBlockSize is not set, members
+	// bigger than 1 MB once compressed are streamed out instead, without
+	// a size hint.
+	MinBlockSize int
+	MaxBlockSize int
+
+	// Split makes the fixed-size writer end each block on a record
+	// boundary, so that every member can be decoded and parsed on its
+	// own. Each block ends at the first boundary found by Split at or
+	// after the block size, unless that makes it longer than MaxBlockSize:
+	// then it ends at the last boundary before MaxBlockSize, or at
+	// MaxBlockSize itself if a single record is longer than that. See
+	// SplitDelimiter for the common case of delimited records.
+	Split RecordSplitFunc
+}
+
+// A RecordSplitFunc returns the length of the first record in data
+// (including its terminator, if any), or zero if data does not contain a
+// complete record.
+type RecordSplitFunc func(data []byte) int
+
+// SplitDelimiter returns a RecordSplitFunc for records terminated by delim,
+// like lines of text ('\n').
+func SplitDelimiter(delim byte) RecordSplitFunc {
+	return func(data []byte) int {
+		return bytes.IndexByte(data, delim) + 1
+	}
+}
+
+var (
+	errInvalidOptions = errors.New("invalid writer options")
+)
+
+// memberLog keeps track of the members written by a Writer, to build the
+// Index of the multi-gzip while it is being generated.
+type memberLog struct {
+	idx  Index
+	crc  hash.Hash32
+	size int64
+}
+
+func newMemberLog() *memberLog {
+	return &memberLog{crc: crc32.NewIEEE()}
+}
+
+// write records that data has been written into the current member.
+func (ml *memberLog) write(data []byte) {
+	ml.crc.Write(data)
+	ml.size += int64(len(data))
+}
+
+// end records that the current member has been closed, and that it occupies
+// the compressed bytes in the range [block, off).
+func (ml *memberLog) end(block int64, off int64) {
+	ml.idx.Members = append(ml.idx.Members, Member{
+		Block:     block,
+		BlockSize: off - block,
+		Start:     ml.idx.Size(),
+		Size:      ml.size,
+		CRC32:     ml.crc.Sum32(),
+	})
+	ml.crc.Reset()
+	ml.size = 0
+}
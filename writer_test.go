@@ -1,12 +1,15 @@
 package multigz
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -31,10 +34,13 @@ func testWriter(t *testing.T, mode ConvertMode) {
 	defer os.Remove(out.Name())
 
 	var outw Writer
-	if mode == ConvertNormal {
+	switch mode {
+	case ConvertNormal:
 		outw, err = NewWriterLevel(out, -1, DefaultBlockSize)
-	} else {
+	case ConvertRsyncable:
 		outw, err = NewWriterLevelRsyncable(out, -1)
+	case ConvertFastCDC:
+		outw, err = NewWriterLevelFastCDC(out, -1, &WriterOptions{AvgBlockSize: 8192})
 	}
 	if err != nil {
 		t.Fatal(err)
@@ -63,7 +69,9 @@ func testWriter(t *testing.T, mode ConvertMode) {
 
 		pos = append(pos, offsets{Off: off, Sum: hex.EncodeToString(sum)})
 	}
-	outw.Close()
+	if err := outw.Close(); err != nil {
+		t.Fatal(err)
+	}
 	gz.Close()
 
 	out.Seek(0, 0)
@@ -75,7 +83,7 @@ func testWriter(t *testing.T, mode ConvertMode) {
 	perm := rand.Perm(len(pos))
 	for _, idx := range perm {
 		p := pos[idx]
-		rgz.Seek(p.Off)
+		rgz.SeekOffset(p.Off)
 		hash := sha1.New()
 		io.CopyN(hash, rgz, 64)
 		sum := hash.Sum([]byte{})
@@ -89,5 +97,412 @@ func TestWriterMassive(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		testWriter(t, ConvertNormal)
 		testWriter(t, ConvertRsyncable)
+		testWriter(t, ConvertFastCDC)
+	}
+}
+
+func TestWriterParallel(t *testing.T) {
+	data := loadDivina(t)
+
+	compress := func(workers int) ([]byte, []Offset) {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelOptions(&buf, -1, 8192, &WriterOptions{Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offs []Offset
+		for d := data; len(d) > 0; {
+			n := len(d)
+			if n > 10000 {
+				n = 10000
+			}
+			if _, err := w.Write(d[:n]); err != nil {
+				t.Fatal(err)
+			}
+			d = d[n:]
+			offs = append(offs, w.Offset())
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), offs
+	}
+
+	serial, soffs := compress(0)
+	for _, workers := range []int{2, 4, 16} {
+		par, poffs := compress(workers)
+		if !bytes.Equal(serial, par) {
+			t.Error("parallel output differs with workers:", workers)
+		}
+		if !reflect.DeepEqual(soffs, poffs) {
+			t.Error("parallel offsets differ with workers:", workers)
+		}
+	}
+}
+
+func BenchmarkWriterParallelOffset(b *testing.B) {
+	data := loadDivina(b)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				w, err := NewWriterLevelOptions(ioutil.Discard, -1, 16384, &WriterOptions{Workers: workers})
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Record an Offset for every line
+				for d := data; len(d) > 0; {
+					n := bytes.IndexByte(d, '\n') + 1
+					if n == 0 {
+						n = len(d)
+					}
+					if _, err := w.Write(d[:n]); err != nil {
+						b.Fatal(err)
+					}
+					d = d[n:]
+					w.Offset()
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterSplit(t *testing.T) {
+	data := loadDivina(t)
+	// Add a record longer than MaxBlockSize
+	long := bytes.Repeat([]byte{'x'}, 40000)
+	data = append(data[:len(data)/2], append(long, data[len(data)/2:]...)...)
+
+	const maxBlock = 16384
+	for _, workers := range []int{0, 4} {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelOptions(&buf, -1, 4096, &WriterOptions{
+			Workers:      workers,
+			Split:        SplitDelimiter('\n'),
+			MaxBlockSize: maxBlock,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offs []Offset
+		var poss []int64
+		for d := data; len(d) > 0; {
+			n := rand.Intn(10000) + 1
+			if n > len(d) {
+				n = len(d)
+			}
+			if _, err := w.Write(d[:n]); err != nil {
+				t.Fatal(err)
+			}
+			d = d[n:]
+			offs = append(offs, w.Offset())
+			poss = append(poss, int64(len(data)-len(d)))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx.Size() != int64(len(data)) {
+			t.Fatal("invalid size:", idx.Size())
+		}
+		for i, m := range idx.Members {
+			if m.Size > maxBlock {
+				t.Errorf("member %d is too big: %d", i, m.Size)
+			}
+			end := m.Start + m.Size
+			if end < int64(len(data)) && data[end-1] != '\n' && m.Size != maxBlock {
+				t.Errorf("member %d does not end on a record boundary", i)
+			}
+		}
+		for i, o := range offs {
+			pos, err := idx.Pos(o)
+			if err != nil || pos != poss[i] {
+				t.Errorf("invalid offset %v: %d instead of %d (%v)", o, pos, poss[i], err)
+			}
+		}
+	}
+}
+
+func TestWriterSplitDefaultMax(t *testing.T) {
+	// Without MaxBlockSize, a long record is cut at 4 times the block size
+	const blocksize = 4096
+	data := append(bytes.Repeat([]byte{'x'}, 100000), '\n')
+	var buf bytes.Buffer
+	w, err := NewWriterLevelOptions(&buf, -1, blocksize, &WriterOptions{Split: SplitDelimiter('\n')})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for d := data; len(d) > 0; d = d[1:] {
+		if _, err := w.Write(d[:1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Size() != int64(len(data)) || len(idx.Members) != len(data)/(4*blocksize)+1 {
+		t.Fatal("invalid members:", idx.Size(), len(idx.Members))
+	}
+	for i, m := range idx.Members[:len(idx.Members)-1] {
+		if m.Size != 4*blocksize {
+			t.Errorf("member %d has size %d", i, m.Size)
+		}
+	}
+}
+
+func TestWriterLargeWrite(t *testing.T) {
+	data := bytes.Repeat(loadDivina(t), 5)
+
+	// A single Write bypasses the bufio.Writer buffer, but blocks must be
+	// cut as usual.
+	const blocksize = 16384
+	for _, split := range []RecordSplitFunc{nil, SplitDelimiter('\n')} {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelOptions(&buf, -1, blocksize, &WriterOptions{Split: split})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx.Size() != int64(len(data)) || len(idx.Members) < len(data)/blocksize-1 {
+			t.Fatal("invalid members:", idx.Size(), len(idx.Members))
+		}
+		for i, m := range idx.Members[:len(idx.Members)-1] {
+			if split == nil {
+				if m.Size != blocksize {
+					t.Errorf("member %d has size %d", i, m.Size)
+				}
+				continue
+			}
+			// Members end at the first line end after the block size
+			end := m.Start + m.Size
+			if m.Size < blocksize || data[end-1] != '\n' ||
+				bytes.IndexByte(data[m.Start+blocksize-1:end-1], '\n') >= 0 {
+				t.Errorf("member %d is not cut after the first line end: %d", i, m.Size)
+			}
+		}
+	}
+}
+
+func TestWriterCut(t *testing.T) {
+	data := loadDivina(t)
+
+	for _, mode := range []ConvertMode{ConvertNormal, ConvertRsyncable, ConvertFastCDC} {
+		var buf bytes.Buffer
+		var w Writer
+		var err error
+		switch mode {
+		case ConvertNormal:
+			w, err = NewWriterLevel(&buf, -1, DefaultBlockSize)
+		case ConvertRsyncable:
+			w, err = NewWriterLevelRsyncable(&buf, -1)
+		case ConvertFastCDC:
+			w, err = NewWriterLevelFastCDC(&buf, -1, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, ok := w.(Cutter)
+		if !ok {
+			t.Fatalf("mode %d: writer does not implement Cutter", mode)
+		}
+
+		cuts := make(map[Offset]int64)
+		for d := data; len(d) > 0; {
+			n := rand.Intn(20000) + 1
+			if n > len(d) {
+				n = len(d)
+			}
+			if _, err := w.Write(d[:n]); err != nil {
+				t.Fatal(err)
+			}
+			d = d[n:]
+			if err := c.Cut(); err != nil {
+				t.Fatal(err)
+			}
+			// A second cut must not generate an empty member
+			if err := c.Cut(); err != nil {
+				t.Fatal(err)
+			}
+			o := w.Offset()
+			if o.Off != 0 {
+				t.Fatalf("mode %d: offset after cut: %v", mode, o)
+			}
+			cuts[o] = int64(len(data) - len(d))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range idx.Members {
+			if m.Size == 0 && len(idx.Members) > 1 {
+				t.Errorf("mode %d: member %d is empty", mode, i)
+			}
+		}
+		for o, pos := range cuts {
+			if p, err := idx.Pos(o); err != nil || p != pos {
+				t.Errorf("mode %d: cut at %v is at %d instead of %d (%v)", mode, o, p, pos, err)
+			}
+		}
+	}
+}
+
+func TestRsyncableOptions(t *testing.T) {
+	data := loadDivina(t)
+	// Add some low-entropy data, where the sum hash does not work well
+	data = append(data, make([]byte, 100000)...)
+
+	compress := func(data []byte, opts *WriterOptions) *Index {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelRsyncableOptions(&buf, -1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatal("invalid decompressed data")
+		}
+		idx, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+
+	for _, hash := range []RollingHash{HashSum, HashBuzhash, HashGear} {
+		opts := &WriterOptions{
+			Hash:         hash,
+			WindowSize:   64,
+			AvgBlockSize: 8192,
+			MinBlockSize: 2048,
+			MaxBlockSize: 32768,
+		}
+		idx := compress(data, opts)
+		for i, m := range idx.Members[:len(idx.Members)-1] {
+			if m.Size < int64(opts.MinBlockSize) || m.Size > int64(opts.MaxBlockSize) {
+				t.Errorf("hash %d: member %d out of bounds: %d", hash, i, m.Size)
+			}
+		}
+
+		// Inserting data at the beginning must not change most of
+		// the following members. The sum hash is not able to find
+		// good boundaries with such a small window, so most blocks
+		// are split at the maximum size and never resync.
+		if hash == HashSum {
+			continue
+		}
+		idx2 := compress(append([]byte("multigz"), data...), opts)
+		crcs := make(map[uint32]bool)
+		for _, m := range idx.Members {
+			crcs[m.CRC32] = true
+		}
+		same := 0
+		for _, m := range idx2.Members {
+			if crcs[m.CRC32] {
+				same++
+			}
+		}
+		if same < len(idx.Members)*9/10 {
+			t.Errorf("hash %d: only %d/%d members are unchanged", hash, same, len(idx.Members))
+		}
+	}
+
+	if _, err := NewWriterLevelRsyncableOptions(ioutil.Discard, -1,
+		&WriterOptions{MinBlockSize: 100, MaxBlockSize: 10}); err == nil {
+		t.Error("invalid options not rejected")
+	}
+}
+
+func TestFastCDC(t *testing.T) {
+	data := loadDivina(t)
+
+	opts := &WriterOptions{MinBlockSize: 2048, AvgBlockSize: 8192, MaxBlockSize: 32768}
+	compress := func(data []byte) *Index {
+		var buf bytes.Buffer
+		w, err := NewWriterLevelFastCDC(&buf, -1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		idx, err := BuildIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+
+	idx := compress(data)
+	avg := idx.Size() / int64(len(idx.Members))
+	if avg < 4096 || avg > 16384 {
+		t.Error("average block size too far from the target:", avg)
+	}
+	for i, m := range idx.Members[:len(idx.Members)-1] {
+		if m.Size < int64(opts.MinBlockSize) || m.Size > int64(opts.MaxBlockSize) {
+			t.Errorf("member %d out of bounds: %d", i, m.Size)
+		}
+	}
+
+	// Delete some data in the middle: only the members around it must
+	// change.
+	mid := len(data) / 2
+	edited := append(append([]byte(nil), data[:mid]...), data[mid+1000:]...)
+	idx2 := compress(edited)
+	crcs := make(map[uint32]bool)
+	for _, m := range idx.Members {
+		crcs[m.CRC32] = true
+	}
+	changed := 0
+	for _, m := range idx2.Members {
+		if !crcs[m.CRC32] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Errorf("%d members changed after a localized edit", changed)
 	}
 }
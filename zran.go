@@ -0,0 +1,204 @@
+package multigz
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// DefaultAccessSpan is a reasonable distance between access points: each one
+// takes up to 32 KiB of memory, and a random access decompresses on average
+// half of the span.
+const DefaultAccessSpan = 1024 * 1024
+
+var (
+	errMultipleMembers = errors.New("multiple gzip members: use BuildIndex")
+)
+
+// An AccessPoint is a position within the deflate stream of an ordinary gzip
+// file where decompression can be resumed. Since deflate blocks are not byte
+// aligned, the block begins at bit Bits (0-7, least significant first) of
+// the byte at offset In. Window holds the decompressed data preceding the
+// access point (at most 32 KiB), which the following blocks can refer to.
+type AccessPoint struct {
+	Out    int64
+	In     int64
+	Bits   uint8
+	Window []byte
+}
+
+// An AccessIndex allows random access into an ordinary gzip file, made of a
+// single gzip member, without rewriting it as a multi-gzip. This is the
+// same technique used by zran.c in the zlib distribution: the file is
+// decompressed once, saving an access point roughly every span bytes. Then,
+// a random access resumes decompression from the nearest access point.
+//
+// Points and Size are all that is needed to access the file: they can be
+// stored elsewhere, and used to recreate the AccessIndex later.
+type AccessIndex struct {
+	Points []AccessPoint
+	Size   int64 // length of the decompressed stream
+}
+
+// BuildAccessIndex decompresses the whole gzip file read from r, saving an
+// access point every span decompressed bytes (more precisely, at the first
+// deflate block boundary after span bytes). The file must be made of a
+// single gzip member: use BuildIndex for multi-gzip files.
+func BuildAccessIndex(r io.Reader, span int64) (*AccessIndex, error) {
+	if span <= 0 {
+		span = DefaultAccessSpan
+	}
+	br := bufio.NewReader(r)
+	_, hlen, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	ai := new(AccessIndex)
+	f := newInflater(br, hlen)
+	last := int64(-span)
+	for final := false; !final; {
+		if f.out-last >= span {
+			pos := f.bitPos()
+			ai.Points = append(ai.Points, AccessPoint{
+				Out:    f.out,
+				In:     pos / 8,
+				Bits:   uint8(pos % 8),
+				Window: f.window(),
+			})
+			last = f.out
+		}
+		if final, err = f.block(); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.trailer(); err != nil {
+		return nil, err
+	}
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == gzipID1 && magic[1] == gzipID2 {
+		return nil, errMultipleMembers
+	}
+	ai.Size = f.out
+	return ai, nil
+}
+
+// An AccessReader gives random access to the decompressed stream of an
+// ordinary gzip file, using an AccessIndex. It has no mutable state, so it
+// is safe to call ReadAt concurrently.
+type AccessReader struct {
+	r  io.ReaderAt
+	ai *AccessIndex
+}
+
+// NewAccessReader creates an AccessReader over the gzip file r. If ai is nil,
+// the whole file is decompressed to build it, with DefaultAccessSpan.
+func NewAccessReader(r io.ReaderAt, ai *AccessIndex) (*AccessReader, error) {
+	if ai == nil {
+		var err error
+		ai, err = BuildAccessIndex(io.NewSectionReader(r, 0, math.MaxInt64), DefaultAccessSpan)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &AccessReader{r: r, ai: ai}, nil
+}
+
+// Size returns the length of the decompressed stream.
+func (ar *AccessReader) Size() int64 {
+	return ar.ai.Size
+}
+
+// Index returns the AccessIndex used by the AccessReader.
+func (ar *AccessReader) Index() *AccessIndex {
+	return ar.ai
+}
+
+// ReadAt reads len(p) bytes of the decompressed stream, starting at position
+// off, decompressing from the nearest access point before it.
+func (ar *AccessReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errSeekOutOfRange
+	}
+	if off >= ar.ai.Size {
+		return 0, io.EOF
+	}
+	points := ar.ai.Points
+	i := sort.Search(len(points), func(i int) bool { return points[i].Out > off }) - 1
+	if i < 0 {
+		return 0, errWrongOffset
+	}
+	pt := &points[i]
+
+	src := &shiftReader{
+		r:    bufio.NewReader(io.NewSectionReader(ar.r, pt.In, math.MaxInt64-pt.In)),
+		bits: uint(pt.Bits),
+	}
+	fr := flate.NewReaderDict(src, pt.Window)
+	defer fr.Close()
+
+	if _, err := io.CopyN(ioutil.Discard, fr, off-pt.Out); err != nil {
+		if err == io.EOF {
+			err = errWrongOffset
+		}
+		return 0, err
+	}
+	n, err := io.ReadFull(fr, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// shiftReader returns the bytes of r shifted right by a number of bits, so
+// that a deflate block beginning in the middle of a byte can be fed to a
+// standard decompressor.
+type shiftReader struct {
+	r     *bufio.Reader
+	bits  uint
+	cur   byte
+	ready bool
+	eof   bool
+}
+
+func (s *shiftReader) ReadByte() (byte, error) {
+	if s.bits == 0 {
+		return s.r.ReadByte()
+	}
+	if !s.ready {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		s.cur, s.ready = b, true
+	}
+	if s.eof {
+		return 0, io.EOF
+	}
+	next, err := s.r.ReadByte()
+	if err == io.EOF {
+		// Return the remaining bits of the last byte
+		s.eof = true
+		return s.cur >> s.bits, nil
+	} else if err != nil {
+		return 0, err
+	}
+	b := s.cur>>s.bits | next<<(8-s.bits)
+	s.cur = next
+	return b, nil
+}
+
+func (s *shiftReader) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := s.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
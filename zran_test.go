@@ -0,0 +1,84 @@
+package multigz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestAccessReader(t *testing.T) {
+	data := loadDivina(t)
+
+	// Recompress with different settings, to exercise stored, fixed and
+	// dynamic blocks.
+	for _, level := range []int{gzip.NoCompression, gzip.HuffmanOnly, gzip.BestSpeed, gzip.BestCompression} {
+		var buf bytes.Buffer
+		gw, _ := gzip.NewWriterLevel(&buf, level)
+		if _, err := gw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		comp := buf.Bytes()
+
+		ai, err := BuildAccessIndex(bytes.NewReader(comp), 32*1024)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if ai.Size != int64(len(data)) {
+			t.Fatalf("level %d: invalid size: %d", level, ai.Size)
+		}
+		if len(ai.Points) < 2 {
+			t.Fatalf("level %d: too few access points: %d", level, len(ai.Points))
+		}
+
+		// The index can be recreated from its exported fields
+		ai = &AccessIndex{Points: ai.Points, Size: ai.Size}
+		ar, err := NewAccessReader(bytes.NewReader(comp), ai)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rnd := rand.New(rand.NewSource(int64(level)))
+		for i := 0; i < 50; i++ {
+			off := rnd.Int63n(int64(len(data)))
+			p := make([]byte, rnd.Intn(100000)+1)
+			n, err := ar.ReadAt(p, off)
+			want := data[off:]
+			if len(want) > len(p) {
+				want = want[:len(p)]
+			}
+			if n < len(p) && err != io.EOF {
+				t.Errorf("level %d: missing EOF at %d: %v", level, off, err)
+			}
+			if n == len(p) && err != nil {
+				t.Errorf("level %d: error at %d: %v", level, off, err)
+			}
+			if string(p[:n]) != string(want) {
+				t.Errorf("level %d: invalid data at %d", level, off)
+			}
+		}
+	}
+}
+
+func TestAccessIndexErrors(t *testing.T) {
+	f, err := os.Open("testdata/divina2.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := BuildAccessIndex(f, 0); err != errMultipleMembers {
+		t.Error("multi-gzip not detected:", err)
+	}
+
+	comp, _ := ioutil.ReadFile("testdata/divina.txt.gz")
+	comp[len(comp)-5] ^= 0xff
+	if _, err := BuildAccessIndex(bytes.NewReader(comp), 0); err == nil {
+		t.Error("corruption not detected")
+	}
+}